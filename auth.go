@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	ScopeReadStatement = "read-statement"
+	ScopePostCredit    = "post-credit"
+	ScopePostDebit     = "post-debit"
+	ScopeManageWebhook = "manage-webhooks"
+)
+
+var (
+	AuthEnabled bool // set by AUTH_ENABLED, when false every request is allowed
+	AllScopes   = []string{ScopeReadStatement, ScopePostCredit, ScopePostDebit, ScopeManageWebhook}
+	ErrNoAPIKey = errors.New("api key not found or revoked")
+)
+
+type APIKey struct {
+	Id         int
+	Name       string
+	Scopes     []string
+	AccountIds []int // nil means the key can be used for every account
+}
+
+func (k APIKey) canAccessAccount(accountId string) bool {
+	if k.AccountIds == nil {
+		return true
+	}
+	id, err := strconv.Atoi(accountId)
+	return err == nil && slices.Contains(k.AccountIds, id)
+}
+
+// allows checks that the key has one of the scopes and can access the account
+func (k APIKey) allows(scopes []string, accountId string) bool {
+	hasScope := slices.ContainsFunc(scopes, func(scope string) bool {
+		return slices.Contains(k.Scopes, scope)
+	})
+	return hasScope && k.canAccessAccount(accountId)
+}
+
+// keys are random, so a plain SHA-256 is enough to avoid storing them in clear text
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAPIKey returns the key in clear text. It is the only time it is available.
+func issueAPIKey(ctx context.Context, name string, scopes []string, accountIds []int) (int, string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(AllScopes, scope) {
+			return 0, "", fmt.Errorf("unknown scope %q, valid scopes are %s", scope, strings.Join(AllScopes, ", "))
+		}
+	}
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return 0, "", err
+	}
+	key := "rinha_" + hex.EncodeToString(secret)
+
+	var id int
+	row := ConnPool.QueryRow(ctx, "INSERT INTO api_keys (name, key_hash, scopes, account_ids) VALUES ($1, $2, $3, $4) RETURNING id;", name, hashAPIKey(key), scopes, accountIds)
+	err = row.Scan(&id)
+	return id, key, err
+}
+
+func revokeAPIKey(ctx context.Context, id int) error {
+	tag, err := ConnPool.Exec(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL;", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoAPIKey
+	}
+	return nil
+}
+
+// requestAPIKey finds the key sent in the Authorization: Bearer <key> header
+func requestAPIKey(r *http.Request) (APIKey, error) {
+	key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || key == "" {
+		return APIKey{}, ErrNoAPIKey
+	}
+	return findAPIKey(r.Context(), key)
+}
+
+func findAPIKey(ctx context.Context, key string) (APIKey, error) {
+	var apiKey APIKey
+	row := ConnPool.QueryRow(ctx, "SELECT id, name, scopes, account_ids FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL;", hashAPIKey(key))
+	err := row.Scan(&apiKey.Id, &apiKey.Name, &apiKey.Scopes, &apiKey.AccountIds)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apiKey, ErrNoAPIKey
+	}
+	return apiKey, err
+}
+
+// transactionScopes peeks at the body's tipo to know which scope is needed, leaving the body untouched for the handler.
+// Unknown types accept any posting scope, the handler rejects them afterwards.
+func transactionScopes(r *http.Request) []string {
+	// reads one byte over the limit, so the handler still rejects bodies that are too large
+	reqBody, err := io.ReadAll(io.LimitReader(r.Body, maxTransactionBodySize+1))
+	r.Body = io.NopCloser(bytes.NewReader(reqBody))
+	if err != nil {
+		return []string{ScopePostCredit, ScopePostDebit}
+	}
+
+	reqBodyDTO, _ := decodeTransactionRequest(reqBody)
+	switch reqBodyDTO.Tipo {
+	case "c":
+		return []string{ScopePostCredit}
+	case "d":
+		return []string{ScopePostDebit}
+	default:
+		return []string{ScopePostCredit, ScopePostDebit}
+	}
+}
+
+func statementScopes(_ *http.Request) []string {
+	return []string{ScopeReadStatement}
+}
+
+func webhookScopes(_ *http.Request) []string {
+	return []string{ScopeManageWebhook}
+}
+
+// authorize requires an API key (Authorization: Bearer <key>) that has one of the scopes
+// needed by the request and that is allowed to access the {id} account.
+func authorize(requiredScopes func(r *http.Request) []string, next http.HandlerFunc) http.HandlerFunc {
+	authorized := requireAPIKey(requiredScopes, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !AuthEnabled {
+			next(w, r)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// requireAPIKey is authorize even when AUTH_ENABLED is false, for the routes that must never be open
+func requireAPIKey(requiredScopes func(r *http.Request) []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, err := requestAPIKey(r)
+		if err == ErrNoAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to find api key: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !apiKey.allows(requiredScopes(r), r.PathValue("id")) {
+			fmt.Fprintf(os.Stderr, "Api key %d is not allowed to %s %s\n", apiKey.Id, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Past balances are answered from balance_checkpoints, taken by the API for every day (UTC) that ended,
+// plus the transactions after the checkpoint. The limit comes from balance_limit_history, fed by a trigger on accounts.
+
+const (
+	checkpointInterval = time.Hour
+	// transactions get created_at when their database transaction starts, so a day is only checkpointed
+	// once the ones started before midnight have had time to commit
+	checkpointDelay = time.Hour
+)
+
+type PointInTimeBalanceResponseBody struct {
+	Total  Money  `json:"total"`
+	Limite Money  `json:"limite"`
+	Em     string `json:"em"`
+}
+
+// lastCheckpointDay is the last day (UTC) that ended at least checkpointDelay before now
+func lastCheckpointDay(now time.Time) time.Time {
+	now = now.UTC().Add(-checkpointDelay)
+	return time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+}
+
+func createBalanceCheckpoints(ctx context.Context, now time.Time) (int, error) {
+	var created int
+	err := ConnPool.QueryRow(ctx, "SELECT create_balance_checkpoints($1);", lastCheckpointDay(now)).Scan(&created)
+	return created, err
+}
+
+// maintainBalanceCheckpoints checkpoints the balances of the day that ended, checking every hour
+// so a restart around midnight does not skip it. Checkpoints already taken are kept.
+func maintainBalanceCheckpoints(ctx context.Context) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		_, err := createBalanceCheckpoints(ctx, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create balance checkpoints: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// balanceAt returns the balance after the transactions made until at (included) and the limit in force then.
+// It is ErrNotFound for an unknown account or one created after at, and ErrArchivedToFile when the transactions
+// it needs were archived to files.
+func balanceAt(ctx context.Context, accountId string, at time.Time) (Account, error) {
+	var account Account
+	var balanceLimit *Money
+	var archivedToFile bool
+	err := readPool(ctx).QueryRow(ctx, stmtBalanceAt, accountId, at).Scan(&account.Balance, &balanceLimit, &archivedToFile)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && balanceLimit == nil) {
+		return account, ErrNotFound
+	}
+	if err != nil {
+		return account, err
+	}
+	if archivedToFile {
+		return account, ErrArchivedToFile
+	}
+	account.BalanceLimit = *balanceLimit
+	return account, nil
+}
+
+func pointInTimeBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	accountId := r.PathValue("id")
+
+	at, err := parseHistoryTime(r.URL.Query().Get("em"))
+	if err != nil {
+		validationErr := &ValidationError{}
+		validationErr.add("em", ErrInvalidHistoryTime)
+		writeValidationError(w, validationErr)
+		return
+	}
+
+	if _, err := strconv.Atoi(accountId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	account, err := balanceAt(r.Context(), accountId, at)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err == ErrArchivedToFile {
+		writeErrorResponse(w, http.StatusConflict, "periodo_arquivado_em_arquivo")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to query the balance at %s: %v\n", at, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	responseBody := PointInTimeBalanceResponseBody{
+		Total:  account.Balance,
+		Limite: account.BalanceLimit,
+		Em:     at.UTC().Format(time.RFC3339Nano),
+	}
+	b, _ := json.Marshal(responseBody)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
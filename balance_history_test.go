@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLastCheckpointDay(t *testing.T) {
+	cases := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// the transactions started before midnight may still be committing
+		{time.Date(2024, 3, 2, 0, 30, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 22, 0, 0, 0, time.FixedZone("BRT", -3*60*60)), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		got := lastCheckpointDay(c.now)
+		if !got.Equal(c.want) {
+			t.Errorf("Now %v: got %v, wants %v", c.now, got, c.want)
+		}
+	}
+}
+
+func TestPointInTimeBalanceValidation(t *testing.T) {
+	for _, query := range []string{"", "em=ontem", "em=2024-03-01T10:00"} {
+		req := httptest.NewRequest("GET", "/clientes/1/saldo?"+query, nil)
+		req.SetPathValue("id", "1")
+		res := httptest.NewRecorder()
+		pointInTimeBalanceHandler(res, req)
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("Query %q: got %d, wants %d", query, res.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	Batcher      *TransactionBatcher // set when BATCH_MAX_SIZE is greater than 1
+	batchMetrics = expvar.NewMap("transaction_batches")
+)
+
+// TransactionBatcher applies concurrent transactions in a single database transaction (group commit),
+// paying for one commit (and its fsync) per batch instead of one per transaction. Batches run one after
+// the other and the transactions of an account keep their arrival order. Batches always use the pessimistic strategy,
+// so main refuses BATCH_MAX_SIZE with any other TRANSACTION_MODE.
+type TransactionBatcher struct {
+	maxSize  int
+	maxWait  time.Duration
+	requests chan batchRequest
+	pending  atomic.Int64
+}
+
+type batchRequest struct {
+	ctx        context.Context
+	accountId  string
+	reqBodyDTO TransactionRequestBody
+	result     chan writeResult
+}
+
+func newTransactionBatcher(maxSize int, maxWait time.Duration) *TransactionBatcher {
+	b := &TransactionBatcher{maxSize: maxSize, maxWait: maxWait, requests: make(chan batchRequest, maxSize)}
+	go b.run()
+	return b
+}
+
+// submit applies the transaction in the next batch. When it is the only transaction in flight there is
+// nothing to batch it with, so it is applied right away with the configured strategy.
+func (b *TransactionBatcher) submit(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	defer b.pending.Add(-1)
+	if b.pending.Add(1) == 1 {
+		batchMetrics.Add("direct", 1)
+		return transactionStrategies[TransactionMode].Execute(ctx, accountId, reqBodyDTO)
+	}
+
+	req := batchRequest{ctx: ctx, accountId: accountId, reqBodyDTO: reqBodyDTO, result: make(chan writeResult, 1)}
+	select {
+	case b.requests <- req:
+	case <-ctx.Done():
+		return Account{}, ctx.Err()
+	}
+
+	select {
+	case result := <-req.result:
+		return result.account, result.err
+	case <-ctx.Done():
+		// the transaction may still be applied, like a request whose client disconnects during the commit
+		return Account{}, ctx.Err()
+	}
+}
+
+func (b *TransactionBatcher) run() {
+	for first := range b.requests {
+		batch := []batchRequest{first}
+		// other transactions are already waiting, so it is worth waiting a little for more
+		if len(b.requests) > 0 {
+			timer := time.NewTimer(b.maxWait)
+		collect:
+			for len(batch) < b.maxSize {
+				select {
+				case req := <-b.requests:
+					batch = append(batch, req)
+				case <-timer.C:
+					break collect
+				}
+			}
+			timer.Stop()
+		}
+		b.execute(batch)
+	}
+}
+
+// execute applies the batch and replies to each caller. Each transaction runs in its own savepoint, so one that fails
+// a check (limit, spending caps...) or hits a database error is rolled back and fails alone while the others commit.
+// A conflict (serialization failure, deadlock) retries the whole batch with inTransaction, and a failed commit fails it.
+func (b *TransactionBatcher) execute(batch []batchRequest) {
+	batchMetrics.Add("batches", 1)
+	batchMetrics.Add("transactions", int64(len(batch)))
+
+	var results []writeResult
+	order := lockOrder(batch)
+	// the transaction is shared by every request, so it must not be canceled by one of them
+	ctx := context.Background()
+	err := inTransaction(ctx, TransactionIsolation, func(tx pgx.Tx) error {
+		results = make([]writeResult, len(batch))
+		for _, i := range order {
+			req := batch[i]
+			if req.ctx.Err() != nil {
+				results[i].err = req.ctx.Err()
+				continue
+			}
+
+			var account Account
+			err := pgx.BeginFunc(ctx, tx, func(savepoint pgx.Tx) error {
+				var err error
+				// the request's values (the rules' outcome) without its cancellation
+				account, err = applyTransaction(context.WithoutCancel(req.ctx), savepoint, req.accountId, req.reqBodyDTO, true)
+				return err
+			})
+			if isConflictError(err) {
+				return err
+			}
+			if err != nil && !isTransactionCheckError(err) {
+				err = fmt.Errorf("failed to apply transaction of client %s in batch: %w", req.accountId, err)
+			}
+			results[i] = writeResult{account: account, err: err}
+		}
+		return nil
+	})
+
+	for i, req := range batch {
+		if err != nil {
+			req.result <- writeResult{err: err}
+			continue
+		}
+		req.result <- results[i]
+	}
+}
+
+// lockOrder returns the indexes of the batch sorted by account id, keeping the arrival order of each account.
+// Every batch locks the accounts in the same order, so the batches of the other replicas cannot deadlock with it.
+func lockOrder(batch []batchRequest) []int {
+	order := make([]int, len(batch))
+	for i := range batch {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		idA, _ := strconv.Atoi(batch[a].accountId)
+		idB, _ := strconv.Atoi(batch[b].accountId)
+		return cmp.Compare(idA, idB)
+	})
+	return order
+}
+
+// isTransactionCheckError tells the errors of the checks made before writing, which leave the database transaction usable
+func isTransactionCheckError(err error) bool {
+	return errors.As(err, new(*ValidationError)) ||
+		errors.Is(err, ErrInvalidAmount) ||
+		errors.Is(err, ErrInvalidDescription) ||
+		errors.Is(err, ErrUnknownBankTransactionType) ||
+		errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrSpendingCapExceeded) ||
+		errors.Is(err, ErrTransactionDenied) ||
+		errors.Is(err, ErrAmountOverflow)
+}
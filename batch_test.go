@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestIsTransactionCheckError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{ErrNotFound, true},
+		{ErrInsufficientFunds, true},
+		{ErrMaxDebitAmount, true},
+		{ErrAmountOverflow, true},
+		{ErrTransactionDenied, true},
+		{fmt.Errorf("failed to check rules: %w", ErrNotFound), true},
+		{ErrWriteQueueFull, false},
+		{ErrArchivedToFile, false},
+		{fmt.Errorf("failed to insert transaction: %w", errors.New("connection reset")), false},
+		{ErrTooManyConflicts, false},
+	}
+
+	for _, c := range cases {
+		if got := isTransactionCheckError(c.err); got != c.want {
+			t.Errorf("%v: got %t, wants %t", c.err, got, c.want)
+		}
+	}
+}
+
+func TestLockOrder(t *testing.T) {
+	var batch []batchRequest
+	for _, accountId := range []string{"3", "10", "2", "3", "1", "10"} {
+		batch = append(batch, batchRequest{accountId: accountId})
+	}
+
+	got := lockOrder(batch)
+	want := []int{4, 2, 0, 3, 1, 5}
+	if !slices.Equal(got, want) {
+		t.Errorf("Got order %v, wants %v", got, want)
+	}
+}
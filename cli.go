@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands are run with `app <command> <subcommand> [flags]` instead of starting the server
+var commands = map[string]func(args []string) error{
+	"account":     accountCommand,
+	"apikey":      apiKeyCommand,
+	"archive":     archiveCommand,
+	"partner":     partnerCommand,
+	"projections": projectionsCommand,
+	"statements":  statementsCommand,
+}
+
+var ErrUsage = errors.New("invalid usage")
+
+func runCommand(args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		os.Exit(2)
+	}
+
+	err := command(args[1:])
+	if errors.Is(err, ErrUsage) || errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func parseIntList(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var ints []int
+	for _, s := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
+
+func apiKeyCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app apikey issue -name <name> -scopes <scope,...> [-accounts <id,...>]")
+		fmt.Fprintln(os.Stderr, "  app apikey revoke <key id>")
+		fmt.Fprintln(os.Stderr, "Scopes: "+strings.Join(AllScopes, ", "))
+	}
+	if len(args) == 0 {
+		usage()
+		return ErrUsage
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "issue":
+		flags := flag.NewFlagSet("apikey issue", flag.ContinueOnError)
+		name := flags.String("name", "", "who is going to use the key")
+		scopes := flags.String("scopes", "", "comma separated scopes")
+		accounts := flags.String("accounts", "", "comma separated account ids the key can access, empty for all accounts")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if *name == "" || *scopes == "" {
+			usage()
+			return ErrUsage
+		}
+
+		accountIds, err := parseIntList(*accounts)
+		if err != nil {
+			return fmt.Errorf("invalid -accounts: %w", err)
+		}
+
+		id, key, err := issueAPIKey(ctx, *name, strings.Split(*scopes, ","), accountIds)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Issued api key %d for %s. Store it now, it cannot be shown again:\n%s\n", id, *name, key)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			usage()
+			return ErrUsage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid key id: %w", err)
+		}
+
+		err = revokeAPIKey(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked api key %d\n", id)
+		return nil
+	default:
+		usage()
+		return ErrUsage
+	}
+}
+
+func partnerCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app partner add-secret -partner <partner id> [-grace <duration>]")
+		fmt.Fprintln(os.Stderr, "  app partner expire-secret <secret id>")
+	}
+	if len(args) == 0 {
+		usage()
+		return ErrUsage
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "add-secret":
+		flags := flag.NewFlagSet("partner add-secret", flag.ContinueOnError)
+		partnerId := flags.String("partner", "", "partner id sent in X-Partner-Id")
+		grace := flags.Duration("grace", 24*time.Hour, "how long the previous secrets keep working")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if *partnerId == "" {
+			usage()
+			return ErrUsage
+		}
+
+		id, secret, err := addPartnerSecret(ctx, *partnerId, *grace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added secret %d for partner %s, previous secrets expire in %s:\n%s\n", id, *partnerId, *grace, secret)
+		return nil
+	case "expire-secret":
+		if len(args) != 2 {
+			usage()
+			return ErrUsage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid secret id: %w", err)
+		}
+
+		err = expirePartnerSecret(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Expired partner secret %d\n", id)
+		return nil
+	default:
+		usage()
+		return ErrUsage
+	}
+}
+
+func projectionsCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app projections verify")
+		fmt.Fprintln(os.Stderr, "  app projections rebuild")
+	}
+	if len(args) != 1 || (args[0] != "verify" && args[0] != "rebuild") {
+		usage()
+		return ErrUsage
+	}
+
+	rebuild := args[0] == "rebuild"
+	report, err := replayProjections(context.Background(), rebuild)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replayed %d transactions of %d clients\n", report.Events, report.Accounts)
+	for _, mismatch := range report.Mismatches {
+		projection := "balance"
+		if mismatch.TransactionId != 0 {
+			projection = fmt.Sprintf("snapshot after transaction %d", mismatch.TransactionId)
+		}
+		fmt.Printf("Client %d: %s is %d, replayed %d\n", mismatch.AccountId, projection, mismatch.Projected, mismatch.Replayed)
+	}
+
+	if rebuild {
+		fmt.Printf("Rebuilt the balances and %d snapshots\n", report.Snapshots)
+		return nil
+	}
+	if len(report.Mismatches) > 0 {
+		return fmt.Errorf("%w: %d found", ErrProjectionMismatch, len(report.Mismatches))
+	}
+	return nil
+}
+
+func accountCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app account export <client id> [-o <file>]")
+		fmt.Fprintln(os.Stderr, "  app account import <file>")
+	}
+	if len(args) < 2 {
+		usage()
+		return ErrUsage
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "export":
+		flags := flag.NewFlagSet("account export", flag.ContinueOnError)
+		output := flags.String("o", "", "file to write the export to, standard output by default")
+		err := flags.Parse(args[2:])
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("invalid client id: %w", err)
+		}
+
+		export, err := exportAccount(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		b, _ := json.MarshalIndent(export, "", "  ")
+		if *output == "" {
+			fmt.Println(string(b))
+			return nil
+		}
+		err = os.WriteFile(*output, b, 0o600)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported client %d with %d transactions to %s\n", export.Cliente.Id, len(export.Transacoes), *output)
+		return nil
+	case "import":
+		if len(args) != 2 {
+			usage()
+			return ErrUsage
+		}
+		b, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		var export AccountExport
+		err = json.Unmarshal(b, &export)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrExportFormat, err)
+		}
+
+		imported, err := importAccount(ctx, export)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported client %d as client %d with %d transactions\n", export.Cliente.Id, imported.AccountId, len(imported.TransactionIds))
+		return nil
+	default:
+		usage()
+		return ErrUsage
+	}
+}
+
+func archiveCommand(args []string) error {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	retention := flags.Int("retention", 12, "months of transactions kept in the partitioned table, the current one included")
+	destination := flags.String("to", ArchiveToTable, "where the older partitions go: table (transactions_archive, still read by the API) or file (no longer read, the API answers 409 for ranges reaching them)")
+	dir := flags.String("dir", ".", "directory of the gzipped CSV files, with -to file")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app archive [-retention <months>] [-to table|file] [-dir <directory>]")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *retention < 1 || (*destination != ArchiveToTable && *destination != ArchiveToFile) {
+		flags.Usage()
+		return ErrUsage
+	}
+
+	archived, err := archiveTransactions(context.Background(), *retention, *destination, *dir, time.Now())
+	for _, partition := range archived {
+		if partition.File != "" {
+			fmt.Printf("Archived %d transactions of %s to %s, the API no longer reads them\n", partition.Transactions, partition.Partition, partition.File)
+		} else {
+			fmt.Printf("Archived %d transactions of %s to transactions_archive\n", partition.Transactions, partition.Partition)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(archived) == 0 {
+		fmt.Println("No partition older than the retention")
+	}
+	return nil
+}
+
+func statementsCommand(args []string) error {
+	flags := flag.NewFlagSet("statements close", flag.ContinueOnError)
+	period := flags.String("periodo", "", "period (YYYY-MM) to close, the last cycle that ended by default")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  app statements close [-periodo <YYYY-MM>]")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "close" {
+		flags.Usage()
+		return ErrUsage
+	}
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	if *period == "" {
+		*period = lastClosedPeriod(time.Now())
+	}
+	_, end, err := statementCycle(*period)
+	if err != nil {
+		return fmt.Errorf("invalid -periodo: %w", err)
+	}
+	if end.After(time.Now().Add(-statementCloseDelay)) {
+		return fmt.Errorf("the cycle of %s ends at %s and cannot be closed yet", *period, end.Format(time.RFC3339))
+	}
+
+	closed, err := closeMonthlyStatements(context.Background(), *period)
+	fmt.Printf("Closed %d statements of %s\n", closed, *period)
+	return err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Balance events are sent with NOTIFY when the bank transaction commits. Every replica LISTENs to the channel
+// and fans the events out to its own subscribers, so a client gets the events committed through any replica.
+
+const (
+	balanceEventsChannel   = "balance_events"
+	eventSubscriberBuffer  = 64
+	eventHeartbeatInterval = 15 * time.Second
+	maxMissedBalanceEvents = 1000 // a client further behind gets a reset event instead of the missed ones
+)
+
+// BalanceEvent is published for every credit or debit
+type BalanceEvent struct {
+	TransacaoId int    `json:"transacao_id"`
+	ClienteId   int    `json:"cliente_id"`
+	Valor       Money  `json:"valor"`
+	Tipo        string `json:"tipo"`
+	Descricao   string `json:"descricao"`
+	RealizadaEm string `json:"realizada_em"`
+	Saldo       Money  `json:"saldo"`
+	Limite      Money  `json:"limite"`
+}
+
+// BalanceResetEvent replaces the missed events when there are more than maxMissedBalanceEvents of them.
+// The client reloads what it needs (e.g. the statement) and continues from the current balance.
+type BalanceResetEvent struct {
+	ClienteId   int   `json:"cliente_id"`
+	TransacaoId int   `json:"transacao_id"` // the last transaction of the account, the stream continues after it
+	Saldo       Money `json:"saldo"`
+	Limite      Money `json:"limite"`
+}
+
+var (
+	Events                   = newBalanceBroker()
+	BalanceEventsEnabled     = false // set by BALANCE_EVENTS (or STATEMENT_CACHE), when false nothing is NOTIFYed nor LISTENed to
+	ErrBalanceEventsDisabled = errors.New("balance events are disabled")
+)
+
+// balanceEventsSetting is the runtime parameter publish_balance_event (seed.sql) reads to NOTIFY the events.
+// It is only set on the connections of replicas that LISTEN, so nobody pays for notifications nobody reads.
+const balanceEventsSetting = "app.notify_balance_events"
+
+// publishBalanceEvent has to run inside the database transaction of the bank transaction.
+// In a single round trip the publish_balance_event function (seed.sql) writes the outbox event and its webhook
+// deliveries (only when the account has active subscriptions) and, with BalanceEventsEnabled, queues the
+// notification, which Postgres only delivers if the transaction commits.
+func publishBalanceEvent(ctx context.Context, tx pgx.Tx, event BalanceEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmtPublishBalanceEvent, event.ClienteId, EventTransactionCreated, payload)
+	return err
+}
+
+type balanceBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan BalanceEvent]struct{}
+}
+
+func newBalanceBroker() *balanceBroker {
+	return &balanceBroker{subscribers: map[int]map[chan BalanceEvent]struct{}{}}
+}
+
+func (b *balanceBroker) subscribe(accountId int) (chan BalanceEvent, func()) {
+	ch := make(chan BalanceEvent, eventSubscriberBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[accountId] == nil {
+		b.subscribers[accountId] = map[chan BalanceEvent]struct{}{}
+	}
+	b.subscribers[accountId][ch] = struct{}{}
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[accountId][ch]; ok {
+			delete(b.subscribers[accountId], ch)
+			close(ch)
+		}
+		if len(b.subscribers[accountId]) == 0 {
+			delete(b.subscribers, accountId)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// publish never blocks the listener. A subscriber that is not keeping up is dropped (its channel is closed),
+// the client reconnects with Last-Event-ID and catches up from the transactions table.
+func (b *balanceBroker) publish(event BalanceEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.ClienteId] {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers[event.ClienteId], ch)
+			close(ch)
+		}
+	}
+}
+
+// startBalanceEventsListener returns once LISTEN is active. The connection is taken out of the pool
+// and, if it breaks, a new one is opened after a short delay.
+func startBalanceEventsListener(ctx context.Context) error {
+	conn, err := listenBalanceEvents(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			notification, err := conn.WaitForNotification(ctx)
+			if ctx.Err() != nil {
+				conn.Close(context.Background())
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Lost connection listening to balance events: %v\n", err)
+				conn.Close(context.Background())
+				for conn, err = listenBalanceEvents(ctx); err != nil && ctx.Err() == nil; conn, err = listenBalanceEvents(ctx) {
+					time.Sleep(time.Second)
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				// the events committed while disconnected are lost, so no cached statement can be trusted
+				StatementCache.clear()
+				continue
+			}
+
+			var event BalanceEvent
+			err = json.Unmarshal([]byte(notification.Payload), &event)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to parse balance event: %v\n", err)
+				continue
+			}
+			Events.publish(event)
+			StatementCache.invalidate(event.ClienteId)
+		}
+	}()
+	return nil
+}
+
+func listenBalanceEvents(ctx context.Context) (*pgx.Conn, error) {
+	poolConn, err := ConnPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := poolConn.Hijack()
+
+	_, err = conn.Exec(ctx, "LISTEN "+balanceEventsChannel)
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// missedBalanceEvents rebuilds the events after lastEventId from the transactions table. Transactions of an account
+// are serialized by the account's row lock, so their ids follow the order in which they changed the balance.
+// Only the newest limit events are read, truncated is true when there were more.
+func missedBalanceEvents(ctx context.Context, accountId int, lastEventId int, limit int) (events []BalanceEvent, truncated bool, err error) {
+	rows, err := ConnPool.Query(ctx, `
+    SELECT t.id, t.amount, t.type, t.description, t.created_at, a.balance_limit,
+      (a.balance - COALESCE(SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END)
+        OVER (ORDER BY t.id DESC ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0))::bigint
+    FROM transactions t
+    JOIN accounts a ON a.id = t.account_id
+    WHERE t.account_id = $1 AND t.id > $2
+    ORDER BY t.id DESC
+    LIMIT $3;`, accountId, lastEventId, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	events = []BalanceEvent{}
+	for rows.Next() {
+		var transaction Transaction
+		event := BalanceEvent{ClienteId: accountId}
+		err = rows.Scan(&event.TransacaoId, &event.Valor, &event.Tipo, &event.Descricao, &transaction.CreatedAt, &event.Limite, &event.Saldo)
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		event.RealizadaEm = transaction.CreatedAt.Time.UTC().Format(time.RFC3339)
+		events = append(events, event)
+	}
+	if len(events) > limit {
+		events, truncated = events[:limit], true
+	}
+	slices.Reverse(events)
+	return events, truncated, rows.Err()
+}
+
+func writeBalanceEvent(w http.ResponseWriter, event BalanceEvent) {
+	b, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: transacao\ndata: %s\n\n", event.TransacaoId, b)
+}
+
+func writeBalanceResetEvent(w http.ResponseWriter, event BalanceResetEvent) {
+	b, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: reset\ndata: %s\n\n", event.TransacaoId, b)
+}
+
+// balanceEventsHandler streams the account's credits and debits as Server-Sent Events.
+// Reconnecting clients send Last-Event-ID (the last transaction id received) to get what they missed.
+func balanceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	accountId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !BalanceEventsEnabled {
+		writeErrorResponse(w, http.StatusServiceUnavailable, "eventos_desabilitados")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var exists bool
+	err = ConnPool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1);", accountId).Scan(&exists)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find account: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// subscribe before catching up, so nothing committed in between is lost
+	events, unsubscribe := Events.subscribe(accountId)
+	defer unsubscribe()
+
+	lastEventId := -1
+	if r.Header.Get("Last-Event-ID") != "" {
+		lastEventId, err = strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disables nginx buffering
+	w.WriteHeader(http.StatusOK)
+
+	if lastEventId >= 0 {
+		missed, truncated, err := missedBalanceEvents(ctx, accountId, lastEventId, maxMissedBalanceEvents)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to query missed balance events: %v\n", err)
+			return
+		}
+		if truncated {
+			// the newest event has the current balance
+			newest := missed[len(missed)-1]
+			writeBalanceResetEvent(w, BalanceResetEvent{ClienteId: accountId, TransacaoId: newest.TransacaoId, Saldo: newest.Saldo, Limite: newest.Limite})
+			missed = nil
+			lastEventId = newest.TransacaoId
+		}
+		for _, event := range missed {
+			writeBalanceEvent(w, event)
+			lastEventId = event.TransacaoId
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.TransacaoId <= lastEventId {
+				continue
+			}
+			writeBalanceEvent(w, event)
+			lastEventId = event.TransacaoId
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// In TRANSACTION_MODE=event_sourced the transactions table is the source of truth: the balance is replayed from
+// the last snapshot in balance_snapshots plus the transactions after it. accounts.balance is kept as a projection
+// for the reads, updated in the same database transaction. Every account starts with a balance of 0.
+
+var (
+	SnapshotInterval      = 100 // set by SNAPSHOT_INTERVAL, transactions of an account between its snapshots
+	ErrProjectionMismatch = errors.New("projections do not match the replayed transactions")
+)
+
+type eventSourcedStrategy struct{}
+
+func (eventSourcedStrategy) Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	var account Account
+	err := inTransaction(ctx, TransactionIsolation, func(tx pgx.Tx) error {
+		var err error
+		account, err = appendTransactionEvent(ctx, tx, accountId, reqBodyDTO)
+		return err
+	})
+	return account, err
+}
+
+// appendTransactionEvent replays the balance, checks the transaction against it and appends it to the ledger
+func appendTransactionEvent(ctx context.Context, tx pgx.Tx, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	var account Account
+	var caps SpendingCaps
+	var eventsSinceSnapshot int
+
+	// the row lock serializes the transactions of the account. The replay is a statement of its own,
+	// so under READ COMMITTED it sees the transactions committed while waiting for the lock.
+	var locked int
+	err := tx.QueryRow(ctx, stmtLockAccount, accountId).Scan(&locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return account, ErrNotFound
+	}
+	if err != nil {
+		return account, err
+	}
+
+	row := tx.QueryRow(ctx, stmtReplayBalance, accountId)
+	err = row.Scan(&account.Balance, &eventsSinceSnapshot, &account.BalanceLimit, &caps.MaxDebitAmount, &caps.MaxDailyDebitTotal, &caps.MaxHourlyDebitCount)
+	if err != nil {
+		return account, err
+	}
+
+	amount := reqBodyDTO.Valor
+	if reqBodyDTO.Tipo == "c" {
+		account.Balance, err = account.Balance.Add(amount)
+		if err != nil {
+			return account, err
+		}
+	} else {
+		newBalance, err := account.Balance.Sub(amount)
+		if err != nil {
+			return account, err
+		}
+		if newBalance < -1*account.BalanceLimit {
+			return account, ErrInsufficientFunds
+		}
+		err = checkSpendingCaps(amount, accountId, caps, tx, ctx)
+		if err != nil {
+			return account, err
+		}
+		err = checkRules(ctx, tx, accountId, amount, reqBodyDTO.Descricao)
+		if err != nil {
+			return account, err
+		}
+		account.Balance = newBalance
+	}
+
+	transaction, err := recordTransaction(ctx, tx, accountId, reqBodyDTO, account)
+	if err != nil {
+		return account, err
+	}
+
+	_, err = tx.Exec(ctx, stmtProjectBalance, account.Balance, accountId)
+	if err != nil {
+		return account, fmt.Errorf("failed to project balance: %w", err)
+	}
+
+	if eventsSinceSnapshot+1 >= SnapshotInterval {
+		_, err = tx.Exec(ctx, stmtInsertSnapshot, accountId, transaction.Id, account.Balance)
+		if err != nil {
+			return account, fmt.Errorf("failed to snapshot balance: %w", err)
+		}
+	}
+	return account, nil
+}
+
+// ProjectionMismatch is a projected balance that differs from the one replayed from the transactions
+type ProjectionMismatch struct {
+	AccountId     int
+	TransactionId int // 0 for accounts.balance, otherwise the snapshot taken after this transaction
+	Projected     Money
+	Replayed      Money
+}
+
+type ReplayReport struct {
+	Accounts   int
+	Events     int
+	Snapshots  int // written by a rebuild
+	Mismatches []ProjectionMismatch
+}
+
+// replayProjections replays every transaction, comparing the balances with accounts.balance and balance_snapshots.
+// With rebuild, the snapshots are taken again every SnapshotInterval transactions and the balances that differ
+// are fixed, while credits and debits wait for it to finish.
+// The transactions archived to files are gone, so an account with some of them starts from its newest snapshot
+// older than its oldest remaining transaction (taken by the archive), which is kept by a rebuild.
+func replayProjections(ctx context.Context, rebuild bool) (ReplayReport, error) {
+	var report ReplayReport
+	err := pgx.BeginTxFunc(ctx, ConnPool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead}, func(tx pgx.Tx) error {
+		report = ReplayReport{}
+		if rebuild {
+			_, err := tx.Exec(ctx, "LOCK TABLE accounts, transactions, transactions_archive IN SHARE MODE;")
+			if err != nil {
+				return err
+			}
+		}
+
+		projected := map[int]Money{}
+		var accountIds []int
+		rows, err := tx.Query(ctx, "SELECT id, balance FROM accounts ORDER BY id;")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var balance Money
+			err = rows.Scan(&id, &balance)
+			if err != nil {
+				return err
+			}
+			projected[id] = balance
+			accountIds = append(accountIds, id)
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		// the snapshots older than every remaining transaction of their account are the archived ones,
+		// the newest of them per account is where its replay starts
+		snapshots := map[[2]int]Money{}
+		replayed := map[int]Money{}
+		rows, err = tx.Query(ctx, `
+      SELECT s.account_id, s.transaction_id, s.balance,
+        NOT EXISTS (SELECT 1 FROM transactions_all t WHERE t.account_id = s.account_id AND t.id <= s.transaction_id)
+      FROM balance_snapshots s
+      ORDER BY s.account_id, s.transaction_id;`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var accountId, transactionId int
+			var balance Money
+			var archived bool
+			err = rows.Scan(&accountId, &transactionId, &balance, &archived)
+			if err != nil {
+				return err
+			}
+			if archived {
+				replayed[accountId] = balance
+				continue
+			}
+			snapshots[[2]int{accountId, transactionId}] = balance
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		events := map[int]int{}
+		var newSnapshots [][]any
+		rows, err = tx.Query(ctx, "SELECT account_id, id, amount, type FROM transactions_all ORDER BY account_id, id;")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var transaction Transaction
+			err = rows.Scan(&transaction.AccountId, &transaction.Id, &transaction.Amount, &transaction.Type)
+			if err != nil {
+				return err
+			}
+
+			balance := replayed[transaction.AccountId]
+			if transaction.Type == "c" {
+				balance, err = balance.Add(transaction.Amount)
+			} else {
+				balance, err = balance.Sub(transaction.Amount)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to replay transaction %d: %w", transaction.Id, err)
+			}
+			replayed[transaction.AccountId] = balance
+			events[transaction.AccountId]++
+			report.Events++
+
+			snapshot, ok := snapshots[[2]int{transaction.AccountId, transaction.Id}]
+			if ok && snapshot != balance {
+				report.Mismatches = append(report.Mismatches, ProjectionMismatch{AccountId: transaction.AccountId, TransactionId: transaction.Id, Projected: snapshot, Replayed: balance})
+			}
+			if events[transaction.AccountId]%SnapshotInterval == 0 {
+				newSnapshots = append(newSnapshots, []any{transaction.AccountId, transaction.Id, balance})
+			}
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		report.Accounts = len(accountIds)
+		for _, id := range accountIds {
+			if projected[id] != replayed[id] {
+				report.Mismatches = append(report.Mismatches, ProjectionMismatch{AccountId: id, Projected: projected[id], Replayed: replayed[id]})
+			}
+		}
+		slices.SortFunc(report.Mismatches, func(a, b ProjectionMismatch) int {
+			if a.AccountId != b.AccountId {
+				return a.AccountId - b.AccountId
+			}
+			return a.TransactionId - b.TransactionId
+		})
+
+		if !rebuild {
+			return nil
+		}
+
+		_, err = tx.Exec(ctx, `
+      DELETE FROM balance_snapshots s
+      WHERE EXISTS (SELECT 1 FROM transactions_all t WHERE t.account_id = s.account_id AND t.id <= s.transaction_id);`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"balance_snapshots"}, []string{"account_id", "transaction_id", "balance"}, pgx.CopyFromRows(newSnapshots))
+		if err != nil {
+			return fmt.Errorf("failed to write snapshots: %w", err)
+		}
+		report.Snapshots = len(newSnapshots)
+
+		for _, mismatch := range report.Mismatches {
+			if mismatch.TransactionId != 0 {
+				continue
+			}
+			_, err = tx.Exec(ctx, stmtProjectBalance, mismatch.Replayed, mismatch.AccountId)
+			if err != nil {
+				return fmt.Errorf("failed to project balance of client %d: %w", mismatch.AccountId, err)
+			}
+		}
+		return nil
+	})
+	return report, err
+}
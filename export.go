@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// An account export is a self-describing JSON document with the account, its spending caps and every transaction
+// (archived to transactions_archive included), moved between databases by `app account export|import`.
+// There are no holds in this schema, so there are none to export.
+
+const (
+	accountExportFormat  = "rinha-de-backend/account-export"
+	accountExportVersion = 1
+)
+
+var (
+	ErrExportFormat          = errors.New("not an account export of a supported version")
+	ErrExportChecksum        = errors.New("account export checksum does not match its content")
+	ErrExportBalanceMismatch = errors.New("account balance does not match the sum of its transactions")
+)
+
+type AccountExport struct {
+	Formato         string                `json:"formato"`
+	Versao          int                   `json:"versao"`
+	ExportadoEm     string                `json:"exportado_em"`
+	Cliente         ExportedAccount       `json:"cliente"`
+	LimitesDeGastos *SpendingCaps         `json:"limites_de_gastos"`
+	Transacoes      []ExportedTransaction `json:"transacoes"`
+	Checksum        string                `json:"checksum"` // sha256 of the document with an empty checksum
+}
+
+type ExportedAccount struct {
+	Id       int    `json:"id"`
+	Nome     string `json:"nome"`
+	Saldo    Money  `json:"saldo"`
+	Limite   Money  `json:"limite"`
+	CriadoEm string `json:"criado_em"`
+}
+
+type ExportedTransaction struct {
+	Id          int    `json:"id"`
+	Valor       Money  `json:"valor"`
+	Tipo        string `json:"tipo"`
+	Descricao   string `json:"descricao"`
+	RealizadaEm string `json:"realizada_em"`
+}
+
+// AccountImport maps the ids of the export to the ones created by the import
+type AccountImport struct {
+	AccountId      int
+	TransactionIds map[int]int
+}
+
+func (e AccountExport) checksum() string {
+	e.Checksum = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// checkBalance replays the transactions from a balance of 0, which is where every account starts
+func (e AccountExport) checkBalance() error {
+	var balance Money
+	var err error
+	for _, transaction := range e.Transacoes {
+		if transaction.Tipo == "c" {
+			balance, err = balance.Add(transaction.Valor)
+		} else {
+			balance, err = balance.Sub(transaction.Valor)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay transaction %d: %w", transaction.Id, err)
+		}
+	}
+	if balance != e.Cliente.Saldo {
+		return fmt.Errorf("%w: balance is %d, transactions sum %d", ErrExportBalanceMismatch, e.Cliente.Saldo, balance)
+	}
+	return nil
+}
+
+// validate checks an export read from a file before importing it
+func (e AccountExport) validate() error {
+	if e.Formato != accountExportFormat || e.Versao != accountExportVersion {
+		return fmt.Errorf("%w: %s version %d", ErrExportFormat, e.Formato, e.Versao)
+	}
+	if e.Checksum != e.checksum() {
+		return ErrExportChecksum
+	}
+	return e.checkBalance()
+}
+
+// exportAccount reads the account and its transactions from one snapshot of the database.
+// Accounts that existed when a partition was archived to a file are not exported, with ErrArchivedToFile.
+func exportAccount(ctx context.Context, accountId string) (AccountExport, error) {
+	export := AccountExport{
+		Formato:     accountExportFormat,
+		Versao:      accountExportVersion,
+		ExportadoEm: time.Now().UTC().Format(time.RFC3339Nano),
+		Transacoes:  []ExportedTransaction{},
+	}
+
+	err := pgx.BeginTxFunc(ctx, ConnPool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var createdAt time.Time
+		err := tx.QueryRow(ctx, "SELECT id, name, balance, balance_limit, created_at FROM accounts WHERE id = $1;", accountId).
+			Scan(&export.Cliente.Id, &export.Cliente.Nome, &export.Cliente.Saldo, &export.Cliente.Limite, &createdAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		export.Cliente.CriadoEm = createdAt.UTC().Format(time.RFC3339Nano)
+		err = checkFileArchives(ctx, tx, createdAt, time.Now())
+		if err != nil {
+			return err
+		}
+
+		var caps SpendingCaps
+		err = tx.QueryRow(ctx, "SELECT max_debit_amount, max_daily_debit_total, max_hourly_debit_count FROM spending_caps WHERE account_id = $1;", accountId).
+			Scan(&caps.MaxDebitAmount, &caps.MaxDailyDebitTotal, &caps.MaxHourlyDebitCount)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			export.LimitesDeGastos = &caps
+		}
+
+		rows, err := tx.Query(ctx, "SELECT id, amount, type, description, created_at FROM transactions_all WHERE account_id = $1 ORDER BY id;", accountId)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var transaction ExportedTransaction
+			err = rows.Scan(&transaction.Id, &transaction.Valor, &transaction.Tipo, &transaction.Descricao, &createdAt)
+			if err != nil {
+				return err
+			}
+			transaction.RealizadaEm = createdAt.UTC().Format(time.RFC3339Nano)
+			export.Transacoes = append(export.Transacoes, transaction)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return export, err
+	}
+
+	err = export.checkBalance()
+	if err != nil {
+		return export, err
+	}
+	export.Checksum = export.checksum()
+	return export, nil
+}
+
+// importAccount creates the account of the export with new ids. The transactions keep their order and dates,
+// the monthly partitions they need are created first (a month in transactions_default could not get one later).
+// The transactions of months already archived go to transactions_archive, a new partition of such a month
+// would be archived again and collide with its entry in transaction_archives.
+func importAccount(ctx context.Context, export AccountExport) (AccountImport, error) {
+	result := AccountImport{TransactionIds: map[int]int{}}
+	err := export.validate()
+	if err != nil {
+		return result, err
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, export.Cliente.CriadoEm)
+	if err != nil {
+		return result, fmt.Errorf("invalid criado_em: %w", err)
+	}
+	var rows [][]any
+	var rowMonths []time.Time
+	months := map[time.Time]bool{}
+	for _, transaction := range export.Transacoes {
+		realizadaEm, err := time.Parse(time.RFC3339Nano, transaction.RealizadaEm)
+		if err != nil {
+			return result, fmt.Errorf("invalid realizada_em of transaction %d: %w", transaction.Id, err)
+		}
+		month := time.Date(realizadaEm.Year(), realizadaEm.Month(), 1, 0, 0, 0, 0, time.UTC)
+		months[month] = true
+		rows = append(rows, []any{0, 0, transaction.Valor, transaction.Tipo, transaction.Descricao, realizadaEm})
+		rowMonths = append(rowMonths, month)
+	}
+
+	err = inTransaction(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		clear(result.TransactionIds)
+		err := tx.QueryRow(ctx, "INSERT INTO accounts (name, balance, balance_limit, created_at) VALUES ($1, $2, $3, $4) RETURNING id;",
+			export.Cliente.Nome, export.Cliente.Saldo, export.Cliente.Limite, createdAt).Scan(&result.AccountId)
+		if err != nil {
+			return err
+		}
+
+		if export.LimitesDeGastos != nil {
+			caps := export.LimitesDeGastos
+			_, err = tx.Exec(ctx, "INSERT INTO spending_caps (account_id, max_debit_amount, max_daily_debit_total, max_hourly_debit_count) VALUES ($1, $2, $3, $4);",
+				result.AccountId, caps.MaxDebitAmount, caps.MaxDailyDebitTotal, caps.MaxHourlyDebitCount)
+			if err != nil {
+				return err
+			}
+		}
+
+		archivedMonths := map[time.Time]bool{}
+		for month := range months {
+			var archived bool
+			err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM transaction_archives WHERE range_start <= $1 AND range_end > $1);", month).Scan(&archived)
+			if err != nil {
+				return err
+			}
+			if archived {
+				archivedMonths[month] = true
+				continue
+			}
+
+			_, err = tx.Exec(ctx, "SELECT create_transaction_partitions($1, 1);", month)
+			if err != nil {
+				return fmt.Errorf("failed to create the partition of %s: %w", month.Format("2006-01"), err)
+			}
+		}
+
+		// nextval is increasing, so the new ids keep the order of the exported ones
+		newIds, err := tx.Query(ctx, "SELECT nextval('transactions_id_seq')::integer FROM generate_series(1, $1);", len(rows))
+		if err != nil {
+			return err
+		}
+		ids, err := pgx.CollectRows(newIds, pgx.RowTo[int])
+		if err != nil {
+			return err
+		}
+		var partitionedRows, archivedRows [][]any
+		for i, id := range ids {
+			rows[i][0] = id
+			rows[i][1] = result.AccountId
+			result.TransactionIds[export.Transacoes[i].Id] = id
+			if archivedMonths[rowMonths[i]] {
+				archivedRows = append(archivedRows, rows[i])
+			} else {
+				partitionedRows = append(partitionedRows, rows[i])
+			}
+		}
+
+		columns := []string{"id", "account_id", "amount", "type", "description", "created_at"}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"transactions"}, columns, pgx.CopyFromRows(partitionedRows))
+		if err != nil {
+			return fmt.Errorf("failed to import transactions: %w", err)
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"transactions_archive"}, columns, pgx.CopyFromRows(archivedRows))
+		if err != nil {
+			return fmt.Errorf("failed to import archived transactions: %w", err)
+		}
+		return nil
+	})
+	if err == nil {
+		StatementCache.invalidate(result.AccountId)
+	}
+	return result, err
+}
+
+func accountExportHandler(w http.ResponseWriter, r *http.Request) {
+	accountId := r.PathValue("id")
+	if _, err := strconv.Atoi(accountId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	export, err := exportAccount(r.Context(), accountId)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err == ErrArchivedToFile {
+		writeErrorResponse(w, http.StatusConflict, "periodo_arquivado_em_arquivo")
+		return
+	}
+	if errors.Is(err, ErrExportBalanceMismatch) {
+		writeErrorResponse(w, http.StatusConflict, "saldo_diverge_das_transacoes")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to export account: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(export)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cliente-%s.json"`, accountId))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAccountExportValidate(t *testing.T) {
+	valid := AccountExport{
+		Formato: accountExportFormat,
+		Versao:  accountExportVersion,
+		Cliente: ExportedAccount{Id: 1, Nome: "o barato sai caro", Saldo: 300, Limite: 100000},
+		Transacoes: []ExportedTransaction{
+			{Id: 1, Valor: 500, Tipo: "c", Descricao: "credito", RealizadaEm: "2024-01-01T00:00:00Z"},
+			{Id: 2, Valor: 200, Tipo: "d", Descricao: "debito", RealizadaEm: "2024-01-02T00:00:00Z"},
+		},
+	}
+	valid.Checksum = valid.checksum()
+
+	tampered := valid
+	tampered.Cliente.Saldo = 1000
+
+	mismatched := tampered
+	mismatched.Checksum = mismatched.checksum()
+
+	unknownVersion := valid
+	unknownVersion.Versao = 2
+	unknownVersion.Checksum = unknownVersion.checksum()
+
+	cases := []struct {
+		name   string
+		export AccountExport
+		want   error
+	}{
+		{"valid", valid, nil},
+		{"tampered", tampered, ErrExportChecksum},
+		{"balance mismatch", mismatched, ErrExportBalanceMismatch},
+		{"unknown version", unknownVersion, ErrExportFormat},
+	}
+
+	for _, c := range cases {
+		err := c.export.validate()
+		if !errors.Is(err, c.want) {
+			t.Errorf("Export %s: got %v, wants %v", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrenbrandao/rinha-de-backend-2024-q1/rinhapb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// rinhaServer exposes the same operations as the HTTP API over gRPC (see proto/rinha.proto).
+// Generate the rinhapb package again with `make proto` after changing the proto file.
+type rinhaServer struct {
+	rinhapb.UnimplementedRinhaServer
+}
+
+// grpcError maps the errors shared with the HTTP API to gRPC status codes
+func grpcError(err error) error {
+	statusCode, code := transactionErrorStatus(err)
+	message := err.Error()
+	if code != "" {
+		message = code + ": " + message
+	}
+
+	// not a conflict to retry, the range needs to change
+	if errors.Is(err, ErrArchivedToFile) {
+		return status.Error(codes.FailedPrecondition, message)
+	}
+
+	switch statusCode {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, message)
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, message)
+	case http.StatusUnprocessableEntity:
+		return status.Error(codes.FailedPrecondition, message)
+	case http.StatusConflict:
+		return status.Error(codes.Aborted, message)
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, message)
+	case http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, message)
+	case http.StatusUnauthorized:
+		return status.Error(codes.Unauthenticated, message)
+	default:
+		fmt.Fprintf(os.Stderr, "gRPC request failed: %v\n", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// authorizeGRPC checks the api key sent in the authorization metadata, the same way authorize does for HTTP
+func authorizeGRPC(ctx context.Context, scopes []string, accountId string) error {
+	if !AuthEnabled {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, ErrNoAPIKey.Error())
+	}
+	key, found := strings.CutPrefix(values[0], "Bearer ")
+	if !found || key == "" {
+		return status.Error(codes.Unauthenticated, ErrNoAPIKey.Error())
+	}
+
+	apiKey, err := findAPIKey(ctx, key)
+	if err == ErrNoAPIKey {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+
+	if !apiKey.allows(scopes, accountId) {
+		return status.Error(codes.PermissionDenied, "api key is not allowed to access this client")
+	}
+	return nil
+}
+
+// rateLimitGRPC takes a token of the client's bucket, shared with the HTTP API, sending the seconds until
+// the next one in the retry-after header when the client is over the limit
+func rateLimitGRPC(ctx context.Context, clientId int32) error {
+	retryAfter, err := checkRateLimit(ctx, int(clientId))
+	if err == ErrRateLimited {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter)))
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+// PostTransaction is refused when signing is enabled, the signature covers the HTTP request and only HTTP has one
+func (s *rinhaServer) PostTransaction(ctx context.Context, req *rinhapb.PostTransactionRequest) (*rinhapb.PostTransactionResponse, error) {
+	if SigningEnabled {
+		return nil, grpcError(ErrSignatureRequired)
+	}
+	accountId := strconv.Itoa(int(req.ClientId))
+	scope := ScopePostCredit
+	if req.Type == "d" {
+		scope = ScopePostDebit
+	}
+	err := authorizeGRPC(ctx, []string{scope}, accountId)
+	if err != nil {
+		return nil, err
+	}
+	err = rateLimitGRPC(ctx, req.ClientId)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := executeTransaction(ctx, accountId, TransactionRequestBody{Valor: Money(req.Amount), Tipo: req.Type, Descricao: req.Description})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &rinhapb.PostTransactionResponse{Limit: int64(account.BalanceLimit), Balance: int64(account.Balance)}, nil
+}
+
+func (s *rinhaServer) GetStatement(ctx context.Context, req *rinhapb.GetStatementRequest) (*rinhapb.Statement, error) {
+	accountId := strconv.Itoa(int(req.ClientId))
+	err := authorizeGRPC(ctx, []string{ScopeReadStatement}, accountId)
+	if err != nil {
+		return nil, err
+	}
+	err = rateLimitGRPC(ctx, req.ClientId)
+	if err != nil {
+		return nil, err
+	}
+
+	statement, err := getActivityStatement(ctx, accountId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	statementDate, _ := time.Parse(time.RFC3339, statement.Saldo.DataExtrato)
+	response := &rinhapb.Statement{
+		Total:         int64(statement.Saldo.Total),
+		Limit:         int64(statement.Saldo.Limite),
+		StatementDate: timestamppb.New(statementDate),
+	}
+	for _, t := range statement.UltimasTransacoes {
+		createdAt, _ := time.Parse(time.RFC3339, t.RealizadaEm)
+		response.LastTransactions = append(response.LastTransactions, &rinhapb.StatementTransaction{
+			Amount:      int64(t.Valor),
+			Type:        t.Tipo,
+			Description: t.Descricao,
+			CreatedAt:   timestamppb.New(createdAt),
+		})
+	}
+	return response, nil
+}
+
+func (s *rinhaServer) StreamStatementHistory(req *rinhapb.StreamStatementHistoryRequest, stream rinhapb.Rinha_StreamStatementHistoryServer) error {
+	ctx := stream.Context()
+	accountId := strconv.Itoa(int(req.ClientId))
+	err := authorizeGRPC(ctx, []string{ScopeReadStatement}, accountId)
+	if err != nil {
+		return err
+	}
+	err = rateLimitGRPC(ctx, req.ClientId)
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if req.Since != nil {
+		since = req.Since.AsTime()
+	}
+
+	err = forEachTransaction(ctx, accountId, since, time.Now(), func(t Transaction) error {
+		return stream.Send(&rinhapb.StatementTransaction{
+			Amount:      int64(t.Amount),
+			Type:        t.Type,
+			Description: t.Description,
+			CreatedAt:   timestamppb.New(t.CreatedAt.Time),
+		})
+	})
+	if err != nil {
+		if _, isStatus := status.FromError(err); isStatus {
+			return err
+		}
+		return grpcError(err)
+	}
+	return nil
+}
+
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	rinhapb.RegisterRinhaServer(server, &rinhaServer{})
+	return server
+}
+
+func serveGRPC(port string) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to listen to gRPC port %s: %v\n", port, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Listening to gRPC requests on port " + port)
+	err = newGRPCServer().Serve(listener)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gRPC server stopped: %v\n", err)
+		os.Exit(1)
+	}
+}
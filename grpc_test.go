@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/andrenbrandao/rinha-de-backend-2024-q1/rinhapb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{ErrNotFound, codes.NotFound},
+		{ErrInvalidAmount, codes.InvalidArgument},
+		{ErrInvalidDescription, codes.InvalidArgument},
+		{ErrUnknownBankTransactionType, codes.InvalidArgument},
+		{ErrInsufficientFunds, codes.FailedPrecondition},
+		{ErrMaxDailyDebitTotal, codes.FailedPrecondition},
+		{ErrTransactionDenied, codes.FailedPrecondition},
+		{fmt.Errorf("%w after 10 attempts", ErrTooManyConflicts), codes.Aborted},
+		{ErrWriteQueueFull, codes.Unavailable},
+		{ErrRateLimited, codes.ResourceExhausted},
+		{ErrSignatureRequired, codes.Unauthenticated},
+		{ErrArchivedToFile, codes.FailedPrecondition},
+		{errors.New("connection refused"), codes.Internal},
+	}
+
+	for _, tt := range tests {
+		got := status.Code(grpcError(tt.err))
+		if got != tt.want {
+			t.Errorf("Error %q: got code %s, wants %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPostTransactionRequiresHTTPWhenSigningIsEnabled(t *testing.T) {
+	SigningEnabled = true
+	defer func() { SigningEnabled = false }()
+
+	_, err := (&rinhaServer{}).PostTransaction(context.Background(), &rinhapb.PostTransactionRequest{ClientId: 1, Amount: 10, Type: "c", Description: "Desc."})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Got error %v, wants code %s", err, codes.Unauthenticated)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyPageSize is the most transactions a response of the history has, the next ones are in the next page
+const historyPageSize = 1000
+
+var (
+	ErrInvalidHistoryTime  = errors.New("needs to be a date (YYYY-MM-DD) or an RFC 3339 time")
+	ErrInvalidHistoryRange = errors.New("needs to be after de")
+	ErrInvalidHistoryPage  = errors.New("needs to be the proxima_pagina of a previous response")
+)
+
+type TransactionHistoryResponseBody struct {
+	Transacoes    []ActivityStatementTransaction `json:"transacoes"`
+	ProximaPagina string                         `json:"proxima_pagina,omitempty"` // set when there are more transactions in the range
+}
+
+// historyCursor is the last transaction of a page, the next page starts after it.
+// Transactions are ordered by created_at and then by id, as several can be created at the same time.
+type historyCursor struct {
+	createdAt time.Time
+	id        int
+}
+
+func (c historyCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.createdAt.UnixMicro(), c.id)))
+}
+
+func parseHistoryCursor(value string) (historyCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return historyCursor{}, ErrInvalidHistoryPage
+	}
+	micros, id, found := strings.Cut(string(b), ":")
+	createdAt, err := strconv.ParseInt(micros, 10, 64)
+	if !found || err != nil {
+		return historyCursor{}, ErrInvalidHistoryPage
+	}
+	cursor := historyCursor{createdAt: time.UnixMicro(createdAt).UTC()}
+	cursor.id, err = strconv.Atoi(id)
+	if err != nil {
+		return historyCursor{}, ErrInvalidHistoryPage
+	}
+	return cursor, nil
+}
+
+// parseHistoryTime accepts a date (2024-01-31, midnight UTC) or an RFC 3339 time
+func parseHistoryTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// transactionHistoryHandler returns the transactions of the account created from `de` until before `ate` (now by default),
+// oldest first, historyPageSize at a time: `pagina` is the proxima_pagina of the previous response.
+// Ranges reaching archived months are read from transactions_archive too, the ones reaching
+// months archived to files are refused with 409.
+func transactionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	accountId := r.PathValue("id")
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	validationErr := &ValidationError{}
+	since, err := parseHistoryTime(query.Get("de"))
+	if err != nil {
+		validationErr.add("de", ErrInvalidHistoryTime)
+	}
+	until := time.Now()
+	if query.Get("ate") != "" {
+		until, err = parseHistoryTime(query.Get("ate"))
+		if err != nil {
+			validationErr.add("ate", ErrInvalidHistoryTime)
+		}
+	}
+	if validationErr.errOrNil() == nil && !since.Before(until) {
+		validationErr.add("ate", ErrInvalidHistoryRange)
+	}
+	cursor := historyCursor{createdAt: since}
+	if query.Get("pagina") != "" {
+		cursor, err = parseHistoryCursor(query.Get("pagina"))
+		if err != nil {
+			validationErr.add("pagina", err)
+		}
+	}
+	if validationErr.errOrNil() != nil {
+		writeValidationError(w, validationErr)
+		return
+	}
+
+	if _, err := strconv.Atoi(accountId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	transactions, err := transactionHistoryPage(ctx, accountId, since, until, cursor)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err == ErrArchivedToFile {
+		writeErrorResponse(w, http.StatusConflict, "periodo_arquivado_em_arquivo")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to query transaction history: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	responseBody := TransactionHistoryResponseBody{Transacoes: []ActivityStatementTransaction{}}
+	if len(transactions) > historyPageSize {
+		transactions = transactions[:historyPageSize]
+		last := transactions[len(transactions)-1]
+		responseBody.ProximaPagina = historyCursor{createdAt: last.CreatedAt.Time, id: last.Id}.String()
+	}
+	for _, t := range transactions {
+		responseBody.Transacoes = append(responseBody.Transacoes, ActivityStatementTransaction{
+			Valor:       t.Amount,
+			Tipo:        t.Type,
+			Descricao:   t.Description,
+			RealizadaEm: t.CreatedAt.Time.UTC().Format(time.RFC3339),
+		})
+	}
+
+	b, _ := json.Marshal(responseBody)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// transactionHistoryPage reads up to historyPageSize + 1 transactions of the range after the cursor,
+// the extra one tells there is a next page
+func transactionHistoryPage(ctx context.Context, accountId string, since, until time.Time, cursor historyCursor) ([]Transaction, error) {
+	db := readPool(ctx)
+	var exists bool
+	err := db.QueryRow(ctx, stmtAccountExists, accountId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	err = checkFileArchives(ctx, db, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmtTransactionsPage, accountId, since, until, cursor.createdAt, cursor.id, historyPageSize+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []Transaction
+	for rows.Next() {
+		var transaction Transaction
+		err = rows.Scan(&transaction.Id, &transaction.AccountId, &transaction.Amount, &transaction.Type, &transaction.Description, &transaction.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, rows.Err()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryTime(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2024-01-31", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), false},
+		{"2024-01-31T10:30:00-03:00", time.Date(2024, 1, 31, 13, 30, 0, 0, time.UTC), false},
+		{"", time.Time{}, true},
+		{"31/01/2024", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseHistoryTime(c.value)
+		if (err != nil) != c.wantErr || !got.Equal(c.want) {
+			t.Errorf("Value %q: got %v (error %v), wants %v", c.value, got, err, c.want)
+		}
+	}
+}
+
+func TestTransactionHistoryValidation(t *testing.T) {
+	cases := []struct {
+		query  string
+		fields []string
+	}{
+		{"", []string{"de"}},
+		{"de=ontem", []string{"de"}},
+		{"de=2024-01-01&ate=amanha", []string{"ate"}},
+		{"de=2024-02-01&ate=2024-01-01", []string{"ate"}},
+		{"de=2024-01-01&ate=2024-01-01", []string{"ate"}},
+		{"de=2024-01-01&pagina=2024-01-02", []string{"pagina"}},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/clientes/1/historico?"+c.query, nil)
+		req.SetPathValue("id", "1")
+		res := httptest.NewRecorder()
+		transactionHistoryHandler(res, req)
+
+		var responseBody ErrorResponseBody
+		json.Unmarshal(res.Body.Bytes(), &responseBody)
+		var fields []string
+		for _, fieldError := range responseBody.Campos {
+			fields = append(fields, fieldError.Campo)
+		}
+		if res.Code != http.StatusBadRequest || !slices.Equal(fields, c.fields) {
+			t.Errorf("Query %q: got %d %v, wants %d %v", c.query, res.Code, fields, http.StatusBadRequest, c.fields)
+		}
+	}
+}
+
+func TestHistoryCursor(t *testing.T) {
+	cursor := historyCursor{createdAt: time.Date(2024, 1, 31, 10, 30, 0, 123456000, time.UTC), id: 42}
+	got, err := parseHistoryCursor(cursor.String())
+	if err != nil || got != cursor {
+		t.Errorf("Got %+v (error %v), wants %+v", got, err, cursor)
+	}
+
+	for _, value := range []string{"abc", "MTcwNjY5NzAwMDEyMzQ1Ng", "eDo0Mg"} {
+		if _, err := parseHistoryCursor(value); err != ErrInvalidHistoryPage {
+			t.Errorf("Value %q: got error %v, wants %v", value, err, ErrInvalidHistoryPage)
+		}
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
@@ -19,15 +22,15 @@ import (
 type Account struct {
 	Id           int                `json:"id"`
 	Name         string             `json:"name"`
-	Balance      int                `json:"balance"`
-	BalanceLimit int                `json:"balance_limit"`
+	Balance      Money              `json:"balance"`
+	BalanceLimit Money              `json:"balance_limit"`
 	CreatedAt    pgtype.Timestamptz `json:"created_at"`
 }
 
 type Transaction struct {
 	Id          int                `json:"id"`
 	AccountId   int                `json:"account_id"`
-	Amount      int                `json:"amount"`
+	Amount      Money              `json:"amount"`
 	Type        string             `json:"type"`
 	Description string             `json:"description"`
 	CreatedAt   pgtype.Timestamptz `json:"created_at"`
@@ -37,7 +40,10 @@ var (
 	ErrInsufficientFunds          = errors.New("account does not have available limit for this debit amount")
 	ErrUnknownBankTransactionType = errors.New("unknown bank transaction type")
 	ErrNotFound                   = errors.New("account not found")
+	ErrInvalidAmount              = errors.New("amount needs to be a positive integer")
+	ErrInvalidDescription         = errors.New("description needs to have length between 1 and 10")
 	ConnPool                      *pgxpool.Pool // shouldn't be global, better to use dependency injection. However, decided to do this way for this challenge.
+	Rules                         *RulesEngine  // pre-authorization rules for debits, nil when RULES_FILE is not set
 )
 
 func seedDB(pool *pgxpool.Pool) {
@@ -47,7 +53,15 @@ func seedDB(pool *pgxpool.Pool) {
 		os.Exit(1)
 	}
 
-	_, err = pool.Exec(context.Background(), string(seedSql))
+	// a connection of its own: the pool's prepare the query catalog, which needs the schema to exist
+	conn, err := pgx.ConnectConfig(context.Background(), pool.Config().ConnConfig.Copy())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(context.Background(), string(seedSql))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to seed database: %v\n", err)
 		os.Exit(1)
@@ -55,7 +69,17 @@ func seedDB(pool *pgxpool.Pool) {
 }
 
 func connectDB(databaseURL string) *pgxpool.Pool {
-	pool, err := pgxpool.New(context.Background(), databaseURL)
+	config, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse database url: %v\n", err)
+		os.Exit(1)
+	}
+	config.AfterConnect = prepareQueryCatalog
+	if BalanceEventsEnabled {
+		config.ConnConfig.RuntimeParams[balanceEventsSetting] = "on"
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to create connection pool to database: %v\n", err)
 		os.Exit(1)
@@ -68,14 +92,26 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 type TransactionRequestBody struct {
-	Valor     int    `json:"valor"`
+	Valor     Money  `json:"valor"`
 	Tipo      string `json:"tipo"` // 'c' for credit and 'd' for debit
 	Descricao string `json:"descricao"`
 }
 
 type TransactionResponseBody struct {
-	Limite int `json:"limite"`
-	Saldo  int `json:"saldo"`
+	Limite Money `json:"limite"`
+	Saldo  Money `json:"saldo"`
+}
+
+type ErrorResponseBody struct {
+	Erro   string       `json:"erro"`
+	Campos []FieldError `json:"campos,omitempty"` // set when the request does not match openapi.json
+}
+
+func writeErrorResponse(w http.ResponseWriter, statusCode int, code string) {
+	b, _ := json.Marshal(ErrorResponseBody{Erro: code})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
 }
 
 func transactionHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,82 +119,54 @@ func transactionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Making transaction for client of id %s...\n", accountId)
 	ctx := r.Context()
 
-	reqBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot read request body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+	reqBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTransactionBodySize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		fmt.Fprintf(os.Stderr, "Request body over %d bytes\n", maxBytesErr.Limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		return
 	}
-
-	var reqBodyDTO TransactionRequestBody
-	err = json.Unmarshal(reqBody, &reqBodyDTO)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot parse request body: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	amount := reqBodyDTO.Valor
-	transactionType := reqBodyDTO.Tipo
-	description := reqBodyDTO.Descricao
-
-	// validations
-	if amount <= 0 {
-		fmt.Fprintf(os.Stderr, "Amount needs to be a positive integer\n")
+		fmt.Fprintf(os.Stderr, "Cannot read request body: %v\n", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if len(description) == 0 || len(description) > 10 {
-		fmt.Fprintf(os.Stderr, "Description needs to have length between 1 and 10\n")
-		w.WriteHeader(http.StatusBadRequest)
+	reqBodyDTO, err := decodeTransactionRequest(reqBody)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		fmt.Fprintf(os.Stderr, "Cannot parse request body: %v\n", err)
+		writeValidationError(w, validationErr)
 		return
 	}
 
-	var account Account
-
-	// wrap queries in a database transaction
-	err = pgx.BeginFunc(ctx, ConnPool, func(tx pgx.Tx) error {
-		// update account's balance
-		switch transactionType {
-		case "c":
-			account, err = executeCredit(amount, accountId, tx, ctx)
-		case "d":
-			account, err = executeDebit(amount, accountId, tx, ctx)
-			if err == ErrInsufficientFunds {
-				w.WriteHeader(http.StatusUnprocessableEntity)
-				return err
-			}
-		default:
-			fmt.Fprint(os.Stderr, "Unknown bank transaction type\n")
-			w.WriteHeader(http.StatusBadRequest)
-			return ErrUnknownBankTransactionType
+	account, err := executeTransaction(ctx, accountId, reqBodyDTO)
+	if err != nil {
+		statusCode, code := transactionErrorStatus(err)
+		fmt.Fprintf(os.Stderr, "Transaction failed: %v\n", err)
+		if errors.As(err, &validationErr) {
+			writeValidationError(w, validationErr)
+			return
 		}
-
-		if err == ErrNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return err
+		if errors.Is(err, ErrWriteQueueFull) {
+			w.Header().Set("Retry-After", "1")
 		}
-
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to update balance: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return err
+		if code != "" {
+			writeErrorResponse(w, statusCode, code)
+			return
 		}
+		w.WriteHeader(statusCode)
+		return
+	}
 
-		// insert bank transaction
-		_, err = tx.Exec(ctx, "INSERT INTO transactions (account_id, amount, type,  description) VALUES ($1, $2, $3, $4);", accountId, amount, transactionType, description)
+	// with a read replica, clients send the LSN back in X-Min-LSN to read their own writes
+	if ReadPool != nil {
+		lsn, err := currentLSN(ctx)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to insert transaction: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return err
+			fmt.Fprintf(os.Stderr, "Unable to get the current LSN: %v\n", err)
+		} else {
+			w.Header().Set("X-LSN", lsn)
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "DB transaction failed: %v\n", err)
-		return
 	}
 
 	// creates http response
@@ -168,20 +176,145 @@ func transactionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func executeCredit(amount int, accountId string, tx pgx.Tx, ctx context.Context) (Account, error) {
+// validateTransactionRequest checks the values of a decoded request, returning a *ValidationError with
+// ErrInvalidAmount, ErrInvalidDescription or ErrUnknownBankTransactionType for the invalid fields
+func validateTransactionRequest(reqBodyDTO TransactionRequestBody) error {
+	validationErr := &ValidationError{}
+	if reqBodyDTO.Valor <= 0 {
+		validationErr.add("valor", ErrInvalidAmount)
+	}
+
+	// length in characters, not bytes, so accented descriptions are not cut short
+	length := utf8.RuneCountInString(reqBodyDTO.Descricao)
+	if length == 0 || length > 10 {
+		validationErr.add("descricao", ErrInvalidDescription)
+	}
+
+	if reqBodyDTO.Tipo != "c" && reqBodyDTO.Tipo != "d" {
+		validationErr.add("tipo", ErrUnknownBankTransactionType)
+	}
+	return validationErr.errOrNil()
+}
+
+// transactionErrorStatus maps the errors of executeTransaction to the HTTP status and, when there is one, the error code of the response body
+func transactionErrorStatus(err error) (int, string) {
+	switch {
+	case errors.As(err, new(*ValidationError)):
+		return http.StatusBadRequest, "requisicao_invalida"
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrInvalidDescription), errors.Is(err, ErrUnknownBankTransactionType):
+		return http.StatusBadRequest, ""
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, ""
+	case errors.Is(err, ErrInsufficientFunds):
+		return http.StatusUnprocessableEntity, ""
+	case errors.Is(err, ErrSpendingCapExceeded):
+		return http.StatusUnprocessableEntity, spendingCapErrorCodes[err]
+	case errors.Is(err, ErrTransactionDenied):
+		return http.StatusUnprocessableEntity, "transacao_recusada"
+	case errors.Is(err, ErrWriteQueueFull):
+		return http.StatusServiceUnavailable, "fila_de_escrita_cheia"
+	case errors.Is(err, ErrTooManyConflicts):
+		return http.StatusConflict, "conflito_de_concorrencia"
+	case errors.Is(err, ErrAmountOverflow):
+		return http.StatusUnprocessableEntity, "saldo_excede_limite_numerico"
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "limite_de_requisicoes"
+	case errors.Is(err, ErrSignatureRequired):
+		return http.StatusUnauthorized, "assinatura_obrigatoria"
+	case errors.Is(err, ErrArchivedToFile):
+		return http.StatusConflict, "periodo_arquivado_em_arquivo"
+	case errors.Is(err, ErrBalanceEventsDisabled):
+		return http.StatusServiceUnavailable, "eventos_desabilitados"
+	default:
+		return http.StatusInternalServerError, ""
+	}
+}
+
+// executeTransaction validates and applies a credit or debit. It is shared by every API (HTTP, WebSocket...),
+// which only have to translate the request and the errors.
+func executeTransaction(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
 	var account Account
-	row := tx.QueryRow(ctx, "UPDATE accounts SET balance = balance + $1 WHERE id = $2 RETURNING balance, balance_limit;", amount, accountId)
-	err := row.Scan(&account.Balance, &account.BalanceLimit)
+	err := validateTransactionRequest(reqBodyDTO)
+	if err != nil {
+		return account, err
+	}
+	amount := reqBodyDTO.Valor
+	transactionType := reqBodyDTO.Tipo
+	description := reqBodyDTO.Descricao
+
+	// pre-authorization rules are evaluated by the strategy after the account's row lock (see checkRules).
+	// The decision is recorded here, after the database transaction, so it is kept even when the debit is denied.
+	var outcome *ruleOutcome
+	if transactionType == "d" && Rules != nil {
+		outcome = &ruleOutcome{}
+		ctx = context.WithValue(ctx, ruleOutcomeKey{}, outcome)
+		defer func() {
+			if !outcome.evaluated {
+				return
+			}
+			input := RuleInput{AccountId: accountId, Amount: amount, Type: transactionType, Description: description}
+			err := recordRuleDecision(context.WithoutCancel(ctx), input, outcome.evaluation, Rules.ShadowMode)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to record rule decision: %v\n", err)
+			}
+			if outcome.evaluation.Decision != DecisionAllow {
+				fmt.Printf("Rules decided %s for debit of client %s (shadow mode: %t): %v\n", outcome.evaluation.Decision, accountId, Rules.ShadowMode, outcome.evaluation.Reasons)
+			}
+		}()
+	}
+
+	id, err := strconv.Atoi(accountId)
+	apply := transactionStrategies[TransactionMode].Execute
+	if Batcher != nil && err == nil {
+		apply = Batcher.submit
+	}
+	if WriteQueue != nil && err == nil {
+		account, err = WriteQueue.submit(ctx, id, func(ctx context.Context) (Account, error) {
+			return apply(ctx, accountId, reqBodyDTO)
+		})
+	} else {
+		account, err = apply(ctx, accountId, reqBodyDTO)
+	}
+	if err == nil {
+		// the balance event also invalidates it, but only after the NOTIFY makes the round trip
+		StatementCache.invalidate(id)
+	}
+	return account, err
+}
+
+func executeCredit(amount Money, accountId string, tx pgx.Tx, ctx context.Context) (Account, error) {
+	var account Account
+	// only balances that can take the amount are updated, so Postgres never fails with bigint out of range
+	maxBalance, err := MaxMoney.Sub(amount)
+	if err != nil {
+		return account, err
+	}
+	row := tx.QueryRow(ctx, stmtCreditAccount, amount, accountId, maxBalance)
+	err = row.Scan(&account.Balance, &account.BalanceLimit)
 	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		err = tx.QueryRow(ctx, stmtAccountExists, accountId).Scan(&exists)
+		if err != nil {
+			return account, err
+		}
+		if exists {
+			return account, ErrAmountOverflow
+		}
 		return account, ErrNotFound
 	}
 	return account, err
 }
 
-func executeDebit(amount int, accountId string, tx pgx.Tx, ctx context.Context) (Account, error) {
+// executeDebit locks the account's row unless lockAccount is false, when the transaction has to be SERIALIZABLE
+func executeDebit(amount Money, accountId string, description string, lockAccount bool, tx pgx.Tx, ctx context.Context) (Account, error) {
 	var currAccount Account
-	row := tx.QueryRow(ctx, "SELECT balance, balance_limit FROM accounts WHERE id = $1 FOR UPDATE;", accountId)
-	err := row.Scan(&currAccount.Balance, &currAccount.BalanceLimit)
+	var caps SpendingCaps
+	query := stmtSelectAccountForDebit
+	if lockAccount {
+		query = stmtLockAccountForDebit
+	}
+	row := tx.QueryRow(ctx, query, accountId)
+	err := row.Scan(&currAccount.Balance, &currAccount.BalanceLimit, &caps.MaxDebitAmount, &caps.MaxDailyDebitTotal, &caps.MaxHourlyDebitCount)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return currAccount, ErrNotFound
 	}
@@ -206,24 +339,38 @@ func executeDebit(amount int, accountId string, tx pgx.Tx, ctx context.Context)
 		time.Sleep(200 * time.Millisecond)
 	}
 
-	if currAccount.Balance-amount < -1*currAccount.BalanceLimit {
+	newBalance, err := currAccount.Balance.Sub(amount)
+	if err != nil {
+		return currAccount, err
+	}
+	if newBalance < -1*currAccount.BalanceLimit {
 		return currAccount, ErrInsufficientFunds
 	}
 
+	err = checkSpendingCaps(amount, accountId, caps, tx, ctx)
+	if err != nil {
+		return currAccount, err
+	}
+
+	err = checkRules(ctx, tx, accountId, amount, description)
+	if err != nil {
+		return currAccount, err
+	}
+
 	var account Account
-	row = tx.QueryRow(ctx, "UPDATE accounts SET balance = balance - $1 WHERE id = $2 RETURNING balance, balance_limit;", amount, accountId)
+	row = tx.QueryRow(ctx, stmtDebitAccount, amount, accountId)
 	err = row.Scan(&account.Balance, &account.BalanceLimit)
 	return account, err
 }
 
 type Saldo struct {
-	Total       int    `json:"total"`
+	Total       Money  `json:"total"`
 	DataExtrato string `json:"data_extrato"`
-	Limite      int    `json:"limite"`
+	Limite      Money  `json:"limite"`
 }
 
 type ActivityStatementTransaction struct {
-	Valor       int    `json:"valor"`
+	Valor       Money  `json:"valor"`
 	Tipo        string `json:"tipo"`
 	Descricao   string `json:"descricao"`
 	RealizadaEm string `json:"realizada_em"`
@@ -251,58 +398,168 @@ func activityStatementHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Reading activity statement of client with id %s...\n", accountId)
 	ctx := r.Context()
 
-	rows, err := ConnPool.Query(ctx, `
-    SELECT a.balance, a.balance_limit, t.amount, t.type, t.description, t.created_at
-    FROM accounts a
-    LEFT JOIN LATERAL (
-      SELECT * FROM transactions t
-      WHERE t.account_id = $1
-      ORDER BY t.created_at DESC
-      LIMIT 10
-    ) t ON true
-    WHERE a.id = $1;`, accountId)
+	responseBody, etag, err := loadActivityStatement(ctx, accountId)
+	if err == ErrNotFound {
+		fmt.Fprintf(os.Stderr, "Account not found\n")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to query transactions: %v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// the ETag ignores data_extrato, so a client polling an unchanged statement gets a 304
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	b, _ := json.Marshal(responseBody)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getActivityStatement(ctx context.Context, accountId string) (ActivityStatementResponseBody, error) {
+	responseBody, _, err := loadActivityStatement(ctx, accountId)
+	return responseBody, err
+}
+
+// loadActivityStatement returns the statement and its ETag, from StatementCache when it is enabled.
+// data_extrato is always the time of the call.
+func loadActivityStatement(ctx context.Context, accountId string) (ActivityStatementResponseBody, string, error) {
+	// a cached statement may miss writes made through other replicas that were not notified yet
+	id, err := strconv.Atoi(accountId)
+	if StatementCache == nil || err != nil || minLSN(ctx) != "" {
+		responseBody, err := queryActivityStatement(ctx, readPool(ctx), accountId)
+		if err != nil {
+			return responseBody, "", err
+		}
+		return responseBody, activityStatementETag(responseBody), nil
+	}
+
+	entry, version, ok := StatementCache.get(id)
+	if !ok {
+		// filled from the primary: a lagging replica could cache a statement older than the last invalidation
+		entry.statement, err = queryActivityStatement(ctx, ConnPool, accountId)
+		if err != nil {
+			return entry.statement, "", err
+		}
+		entry.etag = activityStatementETag(entry.statement)
+		StatementCache.store(id, version, entry)
+	}
+
+	responseBody := entry.statement
+	responseBody.Saldo.DataExtrato = time.Now().UTC().Format(time.RFC3339)
+	return responseBody, entry.etag, nil
+}
+
+func queryActivityStatement(ctx context.Context, db *pgxpool.Pool, accountId string) (ActivityStatementResponseBody, error) {
+	var responseBody ActivityStatementResponseBody
+	rows, err := db.Query(ctx, stmtActivityStatement, accountId)
+	if err != nil {
+		return responseBody, err
+	}
+	defer rows.Close()
+
 	var account Account
 	lastTransactions := []ActivityStatementTransaction{}
 
 	hasNextRow := rows.Next()
 	if !hasNextRow {
-		fmt.Fprintf(os.Stderr, "Account not found\n")
-		w.WriteHeader(http.StatusNotFound)
-		return
+		if rows.Err() != nil {
+			return responseBody, rows.Err()
+		}
+		return responseBody, ErrNotFound
 	}
 
 	for hasNextRow {
 		var transaction TransactionDBModel
 		err = rows.Scan(&account.Balance, &account.BalanceLimit, &transaction.Amount, &transaction.Type, &transaction.Description, &transaction.CreatedAt)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to query transactions: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return responseBody, err
 		}
 
 		if transaction.Amount.Valid {
-			activityStatementTransaction := ActivityStatementTransaction{Valor: int(transaction.Amount.Int64), Tipo: transaction.Type.String, Descricao: transaction.Description.String, RealizadaEm: transaction.CreatedAt.Time.UTC().Format(time.RFC3339)}
+			activityStatementTransaction := ActivityStatementTransaction{Valor: Money(transaction.Amount.Int64), Tipo: transaction.Type.String, Descricao: transaction.Description.String, RealizadaEm: transaction.CreatedAt.Time.UTC().Format(time.RFC3339)}
 			lastTransactions = append(lastTransactions, activityStatementTransaction)
 		}
 
 		hasNextRow = rows.Next()
 	}
 
-	responseBody := ActivityStatementResponseBody{
+	responseBody = ActivityStatementResponseBody{
 		Saldo:             Saldo{Total: account.Balance, Limite: account.BalanceLimit, DataExtrato: time.Now().UTC().Format(time.RFC3339)},
 		UltimasTransacoes: lastTransactions,
 	}
+	return responseBody, rows.Err()
+}
 
-	b, _ := json.Marshal(responseBody)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+// forEachTransaction calls fn with every transaction of the account created at or after since and before until,
+// oldest first. Transactions moved to transactions_archive are included.
+func forEachTransaction(ctx context.Context, accountId string, since, until time.Time, fn func(transaction Transaction) error) error {
+	db := readPool(ctx)
+	var exists bool
+	err := db.QueryRow(ctx, stmtAccountExists, accountId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	err = checkFileArchives(ctx, db, since, until)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(ctx, stmtTransactionsBetween, accountId, since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transaction Transaction
+		err = rows.Scan(&transaction.Id, &transaction.AccountId, &transaction.Amount, &transaction.Type, &transaction.Description, &transaction.CreatedAt)
+		if err != nil {
+			return err
+		}
+		err = fn(transaction)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+type apiRoute struct {
+	Pattern string
+	Handler http.HandlerFunc
+}
+
+// apiRoutes lists every route of the HTTP API, each one has to be documented in openapi.json.
+// The rate limit runs after the signature and the api key, so only authenticated callers spend a client's tokens,
+// and the OpenAPI validation wraps the handler itself.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{"GET /health", validateRequest("GET /health", healthHandler)},
+		{"GET /openapi.json", validateRequest("GET /openapi.json", openAPIHandler)},
+		{"POST /clientes/{id}/transacoes", verifySignature(authorize(transactionScopes, rateLimit(validateRequest("POST /clientes/{id}/transacoes", transactionHandler))))},
+		{"GET /clientes/{id}/extrato", authorize(statementScopes, rateLimit(readYourWrites(validateRequest("GET /clientes/{id}/extrato", activityStatementHandler))))},
+		{"GET /clientes/{id}/exportacao", authorize(statementScopes, rateLimit(validateRequest("GET /clientes/{id}/exportacao", accountExportHandler)))},
+		{"GET /clientes/{id}/historico", authorize(statementScopes, rateLimit(readYourWrites(validateRequest("GET /clientes/{id}/historico", transactionHistoryHandler))))},
+		{"GET /clientes/{id}/extratos/{periodo}", authorize(statementScopes, rateLimit(validateRequest("GET /clientes/{id}/extratos/{periodo}", monthlyStatementHandler)))},
+		{"GET /clientes/{id}/saldo", authorize(statementScopes, rateLimit(readYourWrites(validateRequest("GET /clientes/{id}/saldo", pointInTimeBalanceHandler))))},
+		{"GET /ws", validateRequest("GET /ws", webSocketHandler)},
+		{"GET /clientes/{id}/eventos", authorize(statementScopes, rateLimit(validateRequest("GET /clientes/{id}/eventos", balanceEventsHandler)))},
+		{"POST /clientes/{id}/webhooks", requireAPIKey(webhookScopes, validateRequest("POST /clientes/{id}/webhooks", createWebhookHandler))},
+		{"DELETE /clientes/{id}/webhooks/{webhookId}", requireAPIKey(webhookScopes, validateRequest("DELETE /clientes/{id}/webhooks/{webhookId}", deleteWebhookHandler))},
+		{"POST /clientes/{id}/webhooks/{webhookId}/reenviar", requireAPIKey(webhookScopes, validateRequest("POST /clientes/{id}/webhooks/{webhookId}/reenviar", replayWebhookHandler))},
+	}
 }
 
 func getEnv(key, fallback string) string {
@@ -314,22 +571,231 @@ func getEnv(key, fallback string) string {
 }
 
 func main() {
-	fmt.Println("Starting up server...")
-
 	PORT := getEnv("PORT", "9999")
+	GRPC_PORT := getEnv("GRPC_PORT", "9090")
 	DB_HOSTNAME := getEnv("DB_HOSTNAME", "localhost")
 	DB_USER := getEnv("DB_USER", "admin")
 	DB_PASS := getEnv("DB_PASS", "123")
 	DB_PORT := getEnv("DB_PORT", "5432")
 	DB_NAME := getEnv("DB_NAME", "rinha-db")
+	DB_READ_HOSTNAME := getEnv("DB_READ_HOSTNAME", "")
+	DB_READ_USER := getEnv("DB_READ_USER", DB_USER)
+	DB_READ_PASS := getEnv("DB_READ_PASS", DB_PASS)
+	DB_READ_PORT := getEnv("DB_READ_PORT", DB_PORT)
+	DB_READ_NAME := getEnv("DB_READ_NAME", DB_NAME)
+
+	RULES_FILE := getEnv("RULES_FILE", "")
+	RATE_LIMIT_RATE := getEnv("RATE_LIMIT_RATE", "")
+	RATE_LIMIT_BURST := getEnv("RATE_LIMIT_BURST", "")
+	AuthEnabled = getEnv("AUTH_ENABLED", "false") == "true"
+	SigningEnabled = getEnv("SIGNING_ENABLED", "false") == "true"
+	SIGNATURE_WINDOW := getEnv("SIGNATURE_WINDOW", "")
+	WEBHOOK_DISPATCH_INTERVAL := getEnv("WEBHOOK_DISPATCH_INTERVAL", "1s")
+	WebhookAllowPrivateNetworks = getEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+	OPENAPI_VALIDATION := getEnv("OPENAPI_VALIDATION", "false")
+	TRANSACTION_MODE := getEnv("TRANSACTION_MODE", TransactionModePessimistic)
+	TRANSACTION_ISOLATION := getEnv("TRANSACTION_ISOLATION", "read_committed")
+	TRANSACTION_MAX_ATTEMPTS := getEnv("TRANSACTION_MAX_ATTEMPTS", "")
+	WRITE_QUEUE_SIZE := getEnv("WRITE_QUEUE_SIZE", "")
+	BATCH_MAX_SIZE := getEnv("BATCH_MAX_SIZE", "")
+	BATCH_MAX_WAIT := getEnv("BATCH_MAX_WAIT", "2ms")
+	STATEMENT_CACHE := getEnv("STATEMENT_CACHE", "false")
+	// the cache relies on the balance events to be invalidated by the other replicas
+	BalanceEventsEnabled = getEnv("BALANCE_EVENTS", "false") == "true" || STATEMENT_CACHE == "true"
+	SNAPSHOT_INTERVAL := getEnv("SNAPSHOT_INTERVAL", "")
+	STATEMENT_CLOSING_DAY := getEnv("STATEMENT_CLOSING_DAY", "1")
+	STATEMENT_MONTHLY_FEE := getEnv("STATEMENT_MONTHLY_FEE", "0")
+	STATEMENT_INTEREST_RATE := getEnv("STATEMENT_INTEREST_RATE", "0")
 
 	ConnPool = connectDB("postgres://" + DB_USER + ":" + DB_PASS + "@" + DB_HOSTNAME + ":" + DB_PORT + "/" + DB_NAME) // sets global pool variable
+	err := checkQueryCatalog(context.Background(), ConnPool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Queries do not match the database schema: %v\n", err)
+		os.Exit(1)
+	}
+	if DB_READ_HOSTNAME != "" {
+		ReadPool = connectDB("postgres://" + DB_READ_USER + ":" + DB_READ_PASS + "@" + DB_READ_HOSTNAME + ":" + DB_READ_PORT + "/" + DB_READ_NAME)
+	}
+
+	// also used by the projections command
+	if SNAPSHOT_INTERVAL != "" {
+		interval, err := strconv.Atoi(SNAPSHOT_INTERVAL)
+		if err != nil || interval < 1 {
+			fmt.Fprintf(os.Stderr, "SNAPSHOT_INTERVAL needs to be a positive integer, got %s\n", SNAPSHOT_INTERVAL)
+			os.Exit(1)
+		}
+		SnapshotInterval = interval
+	}
+
+	// also used by the statements command
+	closingDay, err := strconv.Atoi(STATEMENT_CLOSING_DAY)
+	if err != nil || closingDay < 1 || closingDay > 28 {
+		fmt.Fprintf(os.Stderr, "STATEMENT_CLOSING_DAY needs to be a day between 1 and 28, got %s\n", STATEMENT_CLOSING_DAY)
+		os.Exit(1)
+	}
+	StatementClosingDay = closingDay
+	monthlyFee, err := strconv.ParseInt(STATEMENT_MONTHLY_FEE, 10, 64)
+	if err != nil || monthlyFee < 0 {
+		fmt.Fprintf(os.Stderr, "STATEMENT_MONTHLY_FEE needs to be a non-negative amount in cents, got %s\n", STATEMENT_MONTHLY_FEE)
+		os.Exit(1)
+	}
+	StatementMonthlyFee = Money(monthlyFee)
+	interestRate, err := strconv.ParseInt(STATEMENT_INTEREST_RATE, 10, 64)
+	if err != nil || interestRate < 0 || interestRate > 10000 {
+		fmt.Fprintf(os.Stderr, "STATEMENT_INTEREST_RATE needs to be basis points between 0 and 10000, got %s\n", STATEMENT_INTEREST_RATE)
+		os.Exit(1)
+	}
+	StatementInterestRate = interestRate
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	fmt.Println("Starting up server...")
+
+	if RULES_FILE != "" {
+		var err error
+		Rules, err = loadRulesEngine(RULES_FILE)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load rules from %s: %v\n", RULES_FILE, err)
+			os.Exit(1)
+		}
+	}
 	// uncomment the seed below if wants to run it locally with go run main.go
 	// seedDB(ConnPool)
 
-	http.HandleFunc("GET /health", healthHandler)
-	http.HandleFunc("POST /clientes/{id}/transacoes", transactionHandler)
-	http.HandleFunc("GET /clientes/{id}/extrato", activityStatementHandler)
+	if RATE_LIMIT_RATE != "" {
+		rate, err := strconv.ParseFloat(RATE_LIMIT_RATE, 64)
+		if err != nil || rate <= 0 {
+			fmt.Fprintf(os.Stderr, "RATE_LIMIT_RATE needs to be a positive number, got %s\n", RATE_LIMIT_RATE)
+			os.Exit(1)
+		}
+		burst := rate
+		if RATE_LIMIT_BURST != "" {
+			burst, err = strconv.ParseFloat(RATE_LIMIT_BURST, 64)
+			if err != nil || burst < 1 {
+				fmt.Fprintf(os.Stderr, "RATE_LIMIT_BURST needs to be a number greater than or equal to 1, got %s\n", RATE_LIMIT_BURST)
+				os.Exit(1)
+			}
+		}
+		Limiter = &RateLimiter{Rate: rate, Burst: max(burst, 1)}
+	}
+
+	if _, ok := transactionStrategies[TRANSACTION_MODE]; !ok {
+		fmt.Fprintf(os.Stderr, "TRANSACTION_MODE needs to be one of %s, got %s\n", strings.Join(transactionModes(), ", "), TRANSACTION_MODE)
+		os.Exit(1)
+	}
+	TransactionMode = TRANSACTION_MODE
+
+	switch TRANSACTION_ISOLATION {
+	case "read_committed":
+		TransactionIsolation = pgx.ReadCommitted
+	case "serializable":
+		TransactionIsolation = pgx.Serializable
+	default:
+		fmt.Fprintf(os.Stderr, "TRANSACTION_ISOLATION needs to be read_committed or serializable, got %s\n", TRANSACTION_ISOLATION)
+		os.Exit(1)
+	}
+
+	if TRANSACTION_MAX_ATTEMPTS != "" {
+		attempts, err := strconv.Atoi(TRANSACTION_MAX_ATTEMPTS)
+		if err != nil || attempts < 1 {
+			fmt.Fprintf(os.Stderr, "TRANSACTION_MAX_ATTEMPTS needs to be a positive integer, got %s\n", TRANSACTION_MAX_ATTEMPTS)
+			os.Exit(1)
+		}
+		TransactionMaxAttempts = attempts
+	}
+
+	if WRITE_QUEUE_SIZE != "" {
+		size, err := strconv.Atoi(WRITE_QUEUE_SIZE)
+		if err != nil || size < 0 {
+			fmt.Fprintf(os.Stderr, "WRITE_QUEUE_SIZE needs to be a non-negative integer, got %s\n", WRITE_QUEUE_SIZE)
+			os.Exit(1)
+		}
+		if size > 0 {
+			WriteQueue = newWriteQueues(size)
+		}
+	}
+
+	if BATCH_MAX_SIZE != "" {
+		size, err := strconv.Atoi(BATCH_MAX_SIZE)
+		if err != nil || size < 1 {
+			fmt.Fprintf(os.Stderr, "BATCH_MAX_SIZE needs to be a positive integer, got %s\n", BATCH_MAX_SIZE)
+			os.Exit(1)
+		}
+		wait, err := time.ParseDuration(BATCH_MAX_WAIT)
+		if err != nil || wait <= 0 {
+			fmt.Fprintf(os.Stderr, "BATCH_MAX_WAIT needs to be a positive duration, got %s\n", BATCH_MAX_WAIT)
+			os.Exit(1)
+		}
+		// batches lock the accounts with SELECT ... FOR UPDATE, they cannot honor the other modes
+		if size > 1 && TransactionMode != TransactionModePessimistic {
+			fmt.Fprintf(os.Stderr, "BATCH_MAX_SIZE needs TRANSACTION_MODE=%s, got %s\n", TransactionModePessimistic, TransactionMode)
+			os.Exit(1)
+		}
+		if size > 1 {
+			Batcher = newTransactionBatcher(size, wait)
+		}
+	}
+
+	if SIGNATURE_WINDOW != "" {
+		window, err := time.ParseDuration(SIGNATURE_WINDOW)
+		if err != nil || window <= 0 {
+			fmt.Fprintf(os.Stderr, "SIGNATURE_WINDOW needs to be a positive duration, got %s\n", SIGNATURE_WINDOW)
+			os.Exit(1)
+		}
+		SignatureWindow = window
+	}
+
+	if SigningEnabled {
+		go purgeExpiredNonces(context.Background())
+	}
+
+	_, err = createTransactionPartitions(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create transaction partitions: %v\n", err)
+		os.Exit(1)
+	}
+	go maintainTransactionPartitions(context.Background())
+	go maintainBalanceCheckpoints(context.Background())
+	go maintainMonthlyStatements(context.Background())
+
+	webhookDispatchInterval, err := time.ParseDuration(WEBHOOK_DISPATCH_INTERVAL)
+	if err != nil || webhookDispatchInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "WEBHOOK_DISPATCH_INTERVAL needs to be a positive duration, got %s\n", WEBHOOK_DISPATCH_INTERVAL)
+		os.Exit(1)
+	}
+	go runWebhookDispatcher(context.Background(), webhookDispatchInterval)
+
+	if STATEMENT_CACHE == "true" {
+		StatementCache = newActivityStatementCache()
+	}
+
+	if BalanceEventsEnabled {
+		err = startBalanceEventsListener(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to listen to balance events: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if OPENAPI_VALIDATION == "true" {
+		OpenAPI, err = loadOpenAPIDocument()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load openapi.json: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// metrics are exposed by expvar on GET /debug/vars
+	for _, route := range apiRoutes() {
+		http.HandleFunc(route.Pattern, route.Handler)
+	}
+
+	if GRPC_PORT != "" {
+		go serveGRPC(GRPC_PORT)
+	}
 
 	fmt.Println("Listening to requests on port " + PORT)
 	log.Fatal(http.ListenAndServe(":"+PORT, nil))
@@ -0,0 +1,126 @@
+-- Creates the tables of spending caps, pre-authorization rules, rate limiting, api keys, signed requests and
+-- webhooks in a database created before them, with the INTEGER money columns 001_money_bigint.sql widens.
+-- The query catalog prepares queries on these tables, so the API does not start without them.
+BEGIN;
+-- Create spending caps (NULL means the cap is disabled)
+CREATE TABLE IF NOT EXISTS spending_caps (
+  account_id INTEGER NOT NULL,
+  max_debit_amount INTEGER,
+  max_daily_debit_total BIGINT,
+  max_hourly_debit_count INTEGER,
+  PRIMARY KEY(account_id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create decisions of the pre-authorization rules
+CREATE TABLE IF NOT EXISTS rule_decisions (
+  id SERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  type VARCHAR NOT NULL,
+  description VARCHAR NOT NULL,
+  decision VARCHAR NOT NULL,
+  reasons TEXT[] NOT NULL,
+  shadow_mode BOOLEAN NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS rule_decisions_account_id_created_at_desc_idx ON rule_decisions(account_id, created_at DESC);
+
+-- Create token buckets of the rate limiter, shared by the API replicas
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+  account_id INTEGER NOT NULL,
+  tokens DOUBLE PRECISION NOT NULL,
+  allowed BOOLEAN NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(account_id)
+);
+
+-- Create api keys, only the SHA-256 of the key is stored
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL NOT NULL,
+  name VARCHAR NOT NULL,
+  key_hash CHAR(64) NOT NULL,
+  scopes TEXT[] NOT NULL,
+  account_ids INTEGER[], -- NULL means every account
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  revoked_at TIMESTAMPTZ,
+  PRIMARY KEY(id),
+  UNIQUE(key_hash)
+);
+
+-- Create partner secrets used to sign requests, a partner can have more than one active secret while rotating them
+CREATE TABLE IF NOT EXISTS partner_secrets (
+  id SERIAL NOT NULL,
+  partner_id VARCHAR NOT NULL,
+  secret VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  expires_at TIMESTAMPTZ,
+  PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS partner_secrets_partner_id_idx ON partner_secrets(partner_id);
+
+-- Create nonces of signed requests to protect against replays
+CREATE TABLE IF NOT EXISTS request_nonces (
+  partner_id VARCHAR NOT NULL,
+  nonce VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(partner_id, nonce)
+);
+
+-- Create webhook subscriptions and the transactional outbox feeding them
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  id SERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  url VARCHAR NOT NULL,
+  secret VARCHAR NOT NULL,
+  active BOOLEAN DEFAULT true NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_account_id_idx ON webhook_subscriptions(account_id) WHERE active;
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+  id BIGSERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  event_type VARCHAR NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id BIGSERIAL NOT NULL,
+  event_id BIGINT NOT NULL,
+  subscription_id INTEGER NOT NULL,
+  status VARCHAR DEFAULT 'pending' NOT NULL, -- 'pending', 'delivered' or 'dead'
+  attempts INTEGER DEFAULT 0 NOT NULL,
+  next_attempt_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  last_error TEXT,
+  delivered_at TIMESTAMPTZ,
+  PRIMARY KEY(id),
+  CONSTRAINT fk_event
+    FOREIGN KEY(event_id)
+      REFERENCES outbox_events(id)
+      ON DELETE CASCADE,
+  CONSTRAINT fk_subscription
+    FOREIGN KEY(subscription_id)
+      REFERENCES webhook_subscriptions(id)
+      ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+-- the buckets were keyed by the account id as text before, they only hold the tokens of the current window
+ALTER TABLE rate_limit_buckets ALTER COLUMN account_id TYPE INTEGER USING account_id::integer;
+COMMIT;
@@ -0,0 +1,11 @@
+-- Widens the money columns of a database created before balances and amounts were BIGINT.
+-- seed.sql already creates them as BIGINT. Rewrites the tables, so run it during a maintenance window.
+-- Runs after 000_account_controls.sql, which creates spending_caps and rule_decisions.
+BEGIN;
+ALTER TABLE accounts
+  ALTER COLUMN balance TYPE BIGINT,
+  ALTER COLUMN balance_limit TYPE BIGINT;
+ALTER TABLE transactions ALTER COLUMN amount TYPE BIGINT;
+ALTER TABLE spending_caps ALTER COLUMN max_debit_amount TYPE BIGINT;
+ALTER TABLE rule_decisions ALTER COLUMN amount TYPE BIGINT;
+COMMIT;
@@ -0,0 +1,15 @@
+-- Creates the balance snapshots of TRANSACTION_MODE=event_sourced in a database created before them.
+-- The query catalog prepares queries on this table, so the API does not start without it.
+BEGIN;
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+  account_id INTEGER NOT NULL,
+  transaction_id INTEGER NOT NULL,
+  balance BIGINT NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(account_id, transaction_id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+COMMIT;
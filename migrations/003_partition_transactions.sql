@@ -0,0 +1,96 @@
+-- Partitions transactions by month of created_at in a database created before the partitioning, creating the
+-- archive tables of `app archive` too. Copies every transaction, so run it during a maintenance window.
+BEGIN;
+ALTER TABLE transactions RENAME TO transactions_unpartitioned;
+ALTER TABLE transactions_unpartitioned RENAME CONSTRAINT transactions_pkey TO transactions_unpartitioned_pkey;
+ALTER INDEX transactions_account_id_created_at_desc_idx RENAME TO transactions_unpartitioned_account_id_created_at_desc_idx;
+-- the sequence would be dropped with the old table
+ALTER SEQUENCE transactions_id_seq OWNED BY NONE;
+
+CREATE TABLE transactions (
+  id INTEGER NOT NULL DEFAULT nextval('transactions_id_seq'),
+  account_id INTEGER NOT NULL,
+  amount BIGINT NOT NULL,
+  type VARCHAR NOT NULL,
+  description VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id, created_at),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+) PARTITION BY RANGE (created_at);
+ALTER SEQUENCE transactions_id_seq OWNED BY transactions.id;
+
+CREATE INDEX transactions_account_id_created_at_desc_idx ON transactions(account_id, created_at DESC);
+
+CREATE TABLE transactions_default PARTITION OF transactions DEFAULT;
+
+CREATE OR REPLACE FUNCTION create_transaction_partitions(p_from TIMESTAMPTZ, p_months INTEGER) RETURNS INTEGER AS $$
+DECLARE
+  v_start TIMESTAMPTZ;
+  v_name TEXT;
+  v_created INTEGER := 0;
+BEGIN
+  -- the API replicas call it at the same time
+  PERFORM pg_advisory_xact_lock(hashtext('create_transaction_partitions'));
+
+  FOR i IN 0..p_months - 1 LOOP
+    v_start := (date_trunc('month', p_from AT TIME ZONE 'UTC') + make_interval(months => i)) AT TIME ZONE 'UTC';
+    v_name := 'transactions_' || to_char(v_start AT TIME ZONE 'UTC', 'YYYY_MM');
+    CONTINUE WHEN to_regclass(v_name) IS NOT NULL;
+
+    EXECUTE format(
+      'CREATE TABLE %I PARTITION OF transactions FOR VALUES FROM (%L) TO (%L)',
+      v_name, v_start, (v_start AT TIME ZONE 'UTC' + INTERVAL '1 month') AT TIME ZONE 'UTC'
+    );
+    v_created := v_created + 1;
+  END LOOP;
+  RETURN v_created;
+END;
+$$ LANGUAGE plpgsql;
+
+-- a partition for every month from the oldest transaction until two months from now
+SELECT create_transaction_partitions(since, (
+  (EXTRACT(YEAR FROM NOW() AT TIME ZONE 'UTC') - EXTRACT(YEAR FROM since AT TIME ZONE 'UTC')) * 12
+  + EXTRACT(MONTH FROM NOW() AT TIME ZONE 'UTC') - EXTRACT(MONTH FROM since AT TIME ZONE 'UTC') + 3
+)::integer)
+FROM (SELECT COALESCE(MIN(created_at), NOW()) AS since FROM transactions_unpartitioned) t;
+
+INSERT INTO transactions (id, account_id, amount, type, description, created_at)
+SELECT id, account_id, amount, type, description, created_at FROM transactions_unpartitioned;
+
+DROP TABLE transactions_unpartitioned;
+
+CREATE TABLE IF NOT EXISTS transactions_archive (
+  id INTEGER NOT NULL,
+  account_id INTEGER NOT NULL,
+  amount BIGINT NOT NULL,
+  type VARCHAR NOT NULL,
+  description VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS transactions_archive_account_id_created_at_desc_idx ON transactions_archive(account_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS transaction_archives (
+  partition VARCHAR NOT NULL,
+  range_start TIMESTAMPTZ NOT NULL,
+  range_end TIMESTAMPTZ NOT NULL,
+  destination VARCHAR NOT NULL,
+  file VARCHAR,
+  transactions INTEGER NOT NULL,
+  archived_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(partition)
+);
+
+CREATE OR REPLACE VIEW transactions_all AS
+  SELECT id, account_id, amount, type, description, created_at FROM transactions
+  UNION ALL
+  SELECT id, account_id, amount, type, description, created_at FROM transactions_archive;
+COMMIT;
@@ -0,0 +1,80 @@
+-- Creates the balance checkpoints and the balance limit history of GET /clientes/{id}/saldo in a database created
+-- before them. Past limit changes were not recorded, so the current limits are taken as in force since the creation
+-- of the accounts. Past balances are computed from the transactions until the checkpoints are taken.
+BEGIN;
+-- Create daily balance checkpoints: the balance of the account at the end of day (UTC), so a past balance
+-- is the last checkpoint before it plus the transactions after the checkpoint
+CREATE TABLE IF NOT EXISTS balance_checkpoints (
+  account_id INTEGER NOT NULL,
+  day DATE NOT NULL,
+  balance BIGINT NOT NULL,
+  PRIMARY KEY(account_id, day),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create the history of the balance limits, recorded by the accounts_balance_limit_history trigger
+CREATE TABLE IF NOT EXISTS balance_limit_history (
+  account_id INTEGER NOT NULL,
+  balance_limit BIGINT NOT NULL,
+  valid_from TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(account_id, valid_from),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create the trigger recording the balance limit of new accounts (from their creation) and its changes
+CREATE OR REPLACE FUNCTION record_balance_limit() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND OLD.balance_limit = NEW.balance_limit THEN
+    RETURN NEW;
+  END IF;
+
+  INSERT INTO balance_limit_history (account_id, balance_limit, valid_from)
+  VALUES (NEW.id, NEW.balance_limit, CASE WHEN TG_OP = 'INSERT' THEN NEW.created_at ELSE NOW() END)
+  ON CONFLICT (account_id, valid_from) DO UPDATE SET balance_limit = EXCLUDED.balance_limit;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER accounts_balance_limit_history
+  AFTER INSERT OR UPDATE OF balance_limit ON accounts
+  FOR EACH ROW EXECUTE FUNCTION record_balance_limit();
+
+INSERT INTO balance_limit_history (account_id, balance_limit, valid_from)
+SELECT id, balance_limit, created_at FROM accounts;
+
+-- Create the function taking the checkpoints of p_day: the last checkpoint of the account before it (or 0)
+-- plus the transactions until the end of the day. Called by the API for the days that ended, returns how many were taken.
+CREATE OR REPLACE FUNCTION create_balance_checkpoints(p_day DATE) RETURNS INTEGER AS $$
+DECLARE
+  v_created INTEGER;
+BEGIN
+  INSERT INTO balance_checkpoints (account_id, day, balance)
+  SELECT a.id, p_day, COALESCE(c.balance, 0) + COALESCE((
+    SELECT SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END)
+    FROM transactions_all t
+    WHERE t.account_id = a.id
+      AND t.created_at >= COALESCE((c.day + 1)::timestamp AT TIME ZONE 'UTC', '-infinity')
+      AND t.created_at < (p_day + 1)::timestamp AT TIME ZONE 'UTC'
+  ), 0)
+  FROM accounts a
+  LEFT JOIN LATERAL (
+    SELECT day, balance FROM balance_checkpoints
+    WHERE account_id = a.id AND day < p_day
+    ORDER BY day DESC
+    LIMIT 1
+  ) c ON true
+  WHERE a.created_at < (p_day + 1)::timestamp AT TIME ZONE 'UTC'
+  ON CONFLICT DO NOTHING;
+
+  GET DIAGNOSTICS v_created = ROW_COUNT;
+  RETURN v_created;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMIT;
@@ -0,0 +1,34 @@
+-- Creates the immutable monthly statements in a database created before them. The query catalog does not use
+-- the table, but the API closes the statements of the last cycle at startup.
+BEGIN;
+CREATE TABLE IF NOT EXISTS monthly_statements (
+  account_id INTEGER NOT NULL,
+  period CHAR(7) NOT NULL, -- 'YYYY-MM', the month the cycle starts
+  period_start TIMESTAMPTZ NOT NULL,
+  period_end TIMESTAMPTZ NOT NULL,
+  opening_balance BIGINT NOT NULL,
+  total_credits BIGINT NOT NULL,
+  total_debits BIGINT NOT NULL,
+  closing_balance BIGINT NOT NULL,
+  fees BIGINT NOT NULL,
+  interest BIGINT NOT NULL,
+  balance_limit BIGINT NOT NULL,
+  transactions JSONB NOT NULL,
+  closed_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(account_id, period),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+);
+
+CREATE OR REPLACE FUNCTION reject_monthly_statement_change() RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'monthly statements are immutable' USING ERRCODE = 'integrity_constraint_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER monthly_statements_immutable
+  BEFORE UPDATE OR DELETE ON monthly_statements
+  FOR EACH ROW EXECUTE FUNCTION reject_monthly_statement_change();
+
+COMMIT;
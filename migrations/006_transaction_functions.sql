@@ -0,0 +1,146 @@
+-- Creates the functions of the transaction modes (TRANSACTION_MODE=function and the conditional strategy) and of the
+-- balance events in a database created before them. Run it again after changing them in seed.sql.
+BEGIN;
+-- Create the function publishing balance events, shared by every transaction mode.
+-- Writes the outbox event and its webhook deliveries (only when the account has active subscriptions)
+-- and, when the session sets app.notify_balance_events (BALANCE_EVENTS), notifies the balance_events channel
+-- (balanceEventsChannel), delivered only if the transaction commits.
+CREATE OR REPLACE FUNCTION publish_balance_event(p_account_id INTEGER, p_event_type VARCHAR, p_payload JSONB)
+RETURNS VOID AS $$
+  WITH event AS (
+    INSERT INTO outbox_events (account_id, event_type, payload)
+    SELECT p_account_id, p_event_type, p_payload
+    WHERE EXISTS (SELECT 1 FROM webhook_subscriptions WHERE account_id = p_account_id AND active)
+    RETURNING id, account_id
+  ), deliveries AS (
+    INSERT INTO webhook_deliveries (event_id, subscription_id)
+    SELECT event.id, s.id
+    FROM event
+    JOIN webhook_subscriptions s ON s.account_id = event.account_id AND s.active
+  )
+  SELECT pg_notify('balance_events', p_payload::text)
+  WHERE current_setting('app.notify_balance_events', true) = 'on';
+$$ LANGUAGE sql;
+
+-- Create the function building the payload of a balance event, the same JSON as BalanceEvent
+CREATE OR REPLACE FUNCTION balance_event_payload(
+  p_transaction_id INTEGER,
+  p_account_id INTEGER,
+  p_amount BIGINT,
+  p_type VARCHAR,
+  p_description VARCHAR,
+  p_created_at TIMESTAMPTZ,
+  p_balance BIGINT,
+  p_balance_limit BIGINT
+) RETURNS JSONB AS $$
+  SELECT jsonb_build_object(
+    'transacao_id', p_transaction_id,
+    'cliente_id', p_account_id,
+    'valor', p_amount,
+    'tipo', p_type,
+    'descricao', p_description,
+    'realizada_em', to_char(p_created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+    'saldo', p_balance,
+    'limite', p_balance_limit
+  );
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Create the function used by TRANSACTION_MODE=function: the credit or debit, the spending caps,
+-- the ledger insert and the balance event in a single call. Failures return an error_code instead of raising.
+DROP FUNCTION IF EXISTS execute_transaction;
+
+CREATE FUNCTION execute_transaction(
+  p_account_id INTEGER,
+  p_amount BIGINT,
+  p_type VARCHAR,
+  p_description VARCHAR,
+  OUT new_balance BIGINT,
+  OUT new_balance_limit BIGINT,
+  OUT error_code VARCHAR
+) AS $$
+DECLARE
+  v_max_debit_amount BIGINT;
+  v_max_daily_debit_total BIGINT;
+  v_max_hourly_debit_count INTEGER;
+  v_daily_total NUMERIC;
+  v_hourly_count BIGINT;
+  v_transaction_id INTEGER;
+  v_created_at TIMESTAMPTZ;
+BEGIN
+  IF p_type = 'c' THEN
+    -- only balances that can take the amount are updated, so the sum never goes out of the bigint range
+    UPDATE accounts SET balance = balance + p_amount
+    WHERE id = p_account_id AND balance <= 9223372036854775807 - p_amount
+    RETURNING balance, balance_limit INTO new_balance, new_balance_limit;
+
+    IF NOT FOUND THEN
+      IF EXISTS (SELECT 1 FROM accounts WHERE id = p_account_id) THEN
+        error_code := 'overflow';
+      ELSE
+        error_code := 'not_found';
+      END IF;
+      RETURN;
+    END IF;
+  ELSIF p_type = 'd' THEN
+    SELECT a.balance, a.balance_limit, c.max_debit_amount, c.max_daily_debit_total, c.max_hourly_debit_count
+    INTO new_balance, new_balance_limit, v_max_debit_amount, v_max_daily_debit_total, v_max_hourly_debit_count
+    FROM accounts a
+    LEFT JOIN spending_caps c ON c.account_id = a.id
+    WHERE a.id = p_account_id
+    FOR UPDATE OF a;
+
+    IF NOT FOUND THEN
+      error_code := 'not_found';
+      RETURN;
+    END IF;
+
+    IF new_balance < -9223372036854775808 + p_amount THEN
+      error_code := 'overflow';
+      RETURN;
+    END IF;
+
+    IF new_balance - p_amount < -new_balance_limit THEN
+      error_code := 'insufficient_funds';
+      RETURN;
+    END IF;
+
+    IF v_max_debit_amount IS NOT NULL AND p_amount > v_max_debit_amount THEN
+      error_code := 'max_debit_amount';
+      RETURN;
+    END IF;
+
+    IF v_max_daily_debit_total IS NOT NULL OR v_max_hourly_debit_count IS NOT NULL THEN
+      SELECT COALESCE(SUM(amount), 0), COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '1 hour')
+      INTO v_daily_total, v_hourly_count
+      FROM transactions
+      WHERE account_id = p_account_id AND type = 'd' AND created_at > NOW() - INTERVAL '24 hours';
+
+      IF v_max_daily_debit_total IS NOT NULL AND v_daily_total + p_amount > v_max_daily_debit_total THEN
+        error_code := 'max_daily_debit_total';
+        RETURN;
+      END IF;
+
+      IF v_max_hourly_debit_count IS NOT NULL AND v_hourly_count + 1 > v_max_hourly_debit_count THEN
+        error_code := 'max_hourly_debit_count';
+        RETURN;
+      END IF;
+    END IF;
+
+    UPDATE accounts SET balance = balance - p_amount
+    WHERE id = p_account_id
+    RETURNING balance, balance_limit INTO new_balance, new_balance_limit;
+  ELSE
+    error_code := 'unknown_type';
+    RETURN;
+  END IF;
+
+  INSERT INTO transactions (account_id, amount, type, description)
+  VALUES (p_account_id, p_amount, p_type, p_description)
+  RETURNING id, created_at INTO v_transaction_id, v_created_at;
+
+  PERFORM publish_balance_event(p_account_id, 'transacao.criada', balance_event_payload(
+    v_transaction_id, p_account_id, p_amount, p_type, p_description, v_created_at, new_balance, new_balance_limit
+  ));
+END;
+$$ LANGUAGE plpgsql;
+COMMIT;
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// Money is an amount in cents. Balances, limits and amounts are BIGINT columns, so Money has the same 64 bits
+// and the credit/debit path uses Add and Sub to fail with ErrAmountOverflow instead of wrapping around.
+type Money int64
+
+const MaxMoney Money = math.MaxInt64
+
+var ErrAmountOverflow = errors.New("balance would overflow")
+
+func (m Money) Add(other Money) (Money, error) {
+	if (other > 0 && m > MaxMoney-other) || (other < 0 && m < math.MinInt64-other) {
+		return 0, ErrAmountOverflow
+	}
+	return m + other, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if (other < 0 && m > MaxMoney+other) || (other > 0 && m < math.MinInt64+other) {
+		return 0, ErrAmountOverflow
+	}
+	return m - other, nil
+}
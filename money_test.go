@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		name     string
+		got      func() (Money, error)
+		want     Money
+		overflow bool
+	}{
+		{"add", func() (Money, error) { return Money(1500).Add(500) }, 2000, false},
+		{"add up to the maximum", func() (Money, error) { return (MaxMoney - 10).Add(10) }, MaxMoney, false},
+		{"add over the maximum", func() (Money, error) { return (MaxMoney - 10).Add(11) }, 0, true},
+		{"add a negative under the minimum", func() (Money, error) { return Money(math.MinInt64).Add(-1) }, 0, true},
+		{"sub below zero", func() (Money, error) { return Money(500).Sub(1000) }, -500, false},
+		{"sub under the minimum", func() (Money, error) { return Money(math.MinInt64 + 10).Sub(11) }, 0, true},
+		{"sub a negative over the maximum", func() (Money, error) { return MaxMoney.Sub(-1) }, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.got()
+		if tt.overflow {
+			if err != ErrAmountOverflow {
+				t.Errorf("%s: got %d and error %v, wants ErrAmountOverflow", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %d and error %v, wants %d", tt.name, got, err, tt.want)
+		}
+	}
+}
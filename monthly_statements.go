@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A monthly statement closes the cycle that starts on StatementClosingDay of its period (YYYY-MM, in UTC)
+// and ends on the same day of the next month. Statements are closed by the API once the cycle ended and
+// kept in monthly_statements, which cannot be changed. The fee and the interest of a statement are charged
+// as debits when it closes, so they are transactions of the next cycle.
+
+const (
+	statementCloseInterval = time.Hour
+	// same as the checkpoints, the transactions started before the end of the cycle may still be committing
+	statementCloseDelay = time.Hour
+	feeDescription      = "tarifa"
+	interestDescription = "juros"
+)
+
+var (
+	StatementClosingDay       = 1   // set by STATEMENT_CLOSING_DAY, day of the month (1 to 28) the cycles close
+	StatementMonthlyFee       Money // set by STATEMENT_MONTHLY_FEE, charged when each statement closes
+	StatementInterestRate     int64 // set by STATEMENT_INTEREST_RATE, basis points of a negative closing balance charged as interest
+	ErrInvalidStatementPeriod = errors.New("needs to be a month (YYYY-MM)")
+)
+
+type MonthlyStatement struct {
+	Periodo       string                         `json:"periodo"`
+	Inicio        string                         `json:"inicio"`
+	Fim           string                         `json:"fim"`
+	SaldoInicial  Money                          `json:"saldo_inicial"`
+	TotalCreditos Money                          `json:"total_creditos"`
+	TotalDebitos  Money                          `json:"total_debitos"`
+	SaldoFinal    Money                          `json:"saldo_final"`
+	Tarifas       Money                          `json:"tarifas"`
+	Juros         Money                          `json:"juros"`
+	Limite        Money                          `json:"limite"`
+	Transacoes    []ActivityStatementTransaction `json:"transacoes"`
+	FechadoEm     string                         `json:"fechado_em"`
+}
+
+// statementCycle returns when the cycle of the period starts and ends
+func statementCycle(period string) (time.Time, time.Time, error) {
+	month, err := time.Parse("2006-01", period)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Date(month.Year(), month.Month(), StatementClosingDay, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// lastClosedPeriod is the period of the last cycle that ended at least statementCloseDelay before now
+func lastClosedPeriod(now time.Time) string {
+	now = now.UTC().Add(-statementCloseDelay)
+	end := time.Date(now.Year(), now.Month(), StatementClosingDay, 0, 0, 0, 0, time.UTC)
+	if end.After(now) {
+		end = end.AddDate(0, -1, 0)
+	}
+	return end.AddDate(0, -1, 0).Format("2006-01")
+}
+
+// statementInterest is StatementInterestRate basis points of a negative balance, rounded down
+func statementInterest(closingBalance Money) Money {
+	if closingBalance >= 0 || StatementInterestRate == 0 {
+		return 0
+	}
+	debt := -int64(closingBalance)
+	return Money(debt/10000*StatementInterestRate + debt%10000*StatementInterestRate/10000)
+}
+
+// maintainMonthlyStatements closes the statements of the last cycle, checking every hour like the checkpoints
+func maintainMonthlyStatements(ctx context.Context) {
+	ticker := time.NewTicker(statementCloseInterval)
+	defer ticker.Stop()
+	for {
+		_, err := closeMonthlyStatements(ctx, lastClosedPeriod(time.Now()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to close monthly statements: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeMonthlyStatements closes the period for the accounts created before its end that do not have its statement
+func closeMonthlyStatements(ctx context.Context, period string) (int, error) {
+	start, end, err := statementCycle(period)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := ConnPool.Query(ctx, `
+    SELECT id FROM accounts a
+    WHERE created_at < $1 AND NOT EXISTS (SELECT 1 FROM monthly_statements WHERE account_id = a.id AND period = $2)
+    ORDER BY id;`, end, period)
+	if err != nil {
+		return 0, err
+	}
+	accountIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+
+	var closed int
+	for _, id := range accountIds {
+		ok, err := closeMonthlyStatement(ctx, strconv.Itoa(id), period, start, end)
+		if err != nil {
+			return closed, fmt.Errorf("failed to close the statement of client %d: %w", id, err)
+		}
+		if ok {
+			closed++
+		}
+	}
+	return closed, nil
+}
+
+// closeMonthlyStatement inserts the statement and charges its fee and interest in one database transaction.
+// It returns false when another API instance closed it first.
+func closeMonthlyStatement(ctx context.Context, accountId, period string, start, end time.Time) (bool, error) {
+	var closed, charged bool
+	err := inTransaction(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		closed, charged = false, false
+		statement := MonthlyStatement{Periodo: period, Transacoes: []ActivityStatementTransaction{}}
+
+		// the balance right before the cycle, 0 for an account created during it
+		var balanceLimit *Money
+		var archivedToFile bool
+		err := tx.QueryRow(ctx, stmtBalanceAt, accountId, start.Add(-time.Microsecond)).Scan(&statement.SaldoInicial, &balanceLimit, &archivedToFile)
+		if err != nil {
+			return err
+		}
+		if archivedToFile {
+			return ErrArchivedToFile
+		}
+		if balanceLimit == nil {
+			statement.SaldoInicial = 0
+		}
+		err = checkFileArchives(ctx, tx, start, end)
+		if err != nil {
+			return err
+		}
+		// the limit in force at the end of the cycle
+		var balanceAtEnd Money
+		err = tx.QueryRow(ctx, stmtBalanceAt, accountId, end.Add(-time.Microsecond)).Scan(&balanceAtEnd, &balanceLimit, &archivedToFile)
+		if err != nil {
+			return err
+		}
+		if balanceLimit != nil {
+			statement.Limite = *balanceLimit
+		}
+
+		rows, err := tx.Query(ctx, stmtTransactionsBetween, accountId, start, end)
+		if err != nil {
+			return err
+		}
+		transactions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Transaction])
+		if err != nil {
+			return err
+		}
+		for _, t := range transactions {
+			if t.Type == "c" {
+				statement.TotalCreditos, err = statement.TotalCreditos.Add(t.Amount)
+			} else {
+				statement.TotalDebitos, err = statement.TotalDebitos.Add(t.Amount)
+			}
+			if err != nil {
+				return err
+			}
+			statement.Transacoes = append(statement.Transacoes, ActivityStatementTransaction{
+				Valor:       t.Amount,
+				Tipo:        t.Type,
+				Descricao:   t.Description,
+				RealizadaEm: t.CreatedAt.Time.UTC().Format(time.RFC3339),
+			})
+		}
+		statement.SaldoFinal, err = statement.SaldoInicial.Add(statement.TotalCreditos)
+		if err == nil {
+			statement.SaldoFinal, err = statement.SaldoFinal.Sub(statement.TotalDebitos)
+		}
+		if err != nil {
+			return err
+		}
+		statement.Tarifas = StatementMonthlyFee
+		statement.Juros = statementInterest(statement.SaldoFinal)
+
+		transactionsJSON, _ := json.Marshal(statement.Transacoes)
+		tag, err := tx.Exec(ctx, `
+      INSERT INTO monthly_statements (account_id, period, period_start, period_end, opening_balance, total_credits,
+        total_debits, closing_balance, fees, interest, balance_limit, transactions)
+      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+      ON CONFLICT DO NOTHING;`,
+			accountId, period, start, end, statement.SaldoInicial, statement.TotalCreditos, statement.TotalDebitos,
+			statement.SaldoFinal, statement.Tarifas, statement.Juros, statement.Limite, transactionsJSON)
+		if err != nil {
+			return err
+		}
+		closed = tag.RowsAffected() == 1
+		if !closed {
+			return nil
+		}
+
+		// charged even over the limit, the account just owes more
+		charges := []TransactionRequestBody{{Valor: statement.Tarifas, Tipo: "d", Descricao: feeDescription}, {Valor: statement.Juros, Tipo: "d", Descricao: interestDescription}}
+		for _, charge := range charges {
+			if charge.Valor == 0 {
+				continue
+			}
+			var account Account
+			err = tx.QueryRow(ctx, stmtDebitAccount, charge.Valor, accountId).Scan(&account.Balance, &account.BalanceLimit)
+			if err != nil {
+				return fmt.Errorf("failed to charge %s: %w", charge.Descricao, err)
+			}
+			_, err = recordTransaction(ctx, tx, accountId, charge, account)
+			if err != nil {
+				return err
+			}
+			charged = true
+		}
+		return nil
+	})
+	if charged {
+		id, _ := strconv.Atoi(accountId)
+		StatementCache.invalidate(id)
+	}
+	return closed, err
+}
+
+func getMonthlyStatement(ctx context.Context, accountId, period string) (MonthlyStatement, error) {
+	statement := MonthlyStatement{Periodo: period}
+	var start, end, closedAt time.Time
+	var transactionsJSON []byte
+	err := readPool(ctx).QueryRow(ctx, `
+    SELECT period_start, period_end, opening_balance, total_credits, total_debits, closing_balance, fees, interest,
+      balance_limit, transactions, closed_at
+    FROM monthly_statements
+    WHERE account_id = $1 AND period = $2;`, accountId, period).Scan(&start, &end, &statement.SaldoInicial,
+		&statement.TotalCreditos, &statement.TotalDebitos, &statement.SaldoFinal, &statement.Tarifas, &statement.Juros,
+		&statement.Limite, &transactionsJSON, &closedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return statement, ErrNotFound
+	}
+	if err != nil {
+		return statement, err
+	}
+
+	statement.Inicio = start.UTC().Format(time.RFC3339)
+	statement.Fim = end.UTC().Format(time.RFC3339)
+	statement.FechadoEm = closedAt.UTC().Format(time.RFC3339)
+	err = json.Unmarshal(transactionsJSON, &statement.Transacoes)
+	return statement, err
+}
+
+// formatMoney writes cents as reais, 123456 as 1.234,56
+func formatMoney(m Money) string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+	}
+	// the last two digits, without negating math.MinInt64
+	reais, rest := cents/100, cents%100
+	if rest < 0 {
+		rest = -rest
+	}
+	digits := strconv.FormatInt(reais, 10)
+	digits = strings.TrimPrefix(digits, "-")
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte('.')
+		}
+		grouped.WriteRune(digit)
+	}
+	return fmt.Sprintf("%s%s,%02d", sign, grouped.String(), rest)
+}
+
+var monthlyStatementTemplate = template.Must(template.New("extrato").Funcs(template.FuncMap{"reais": formatMoney}).Parse(`<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+<meta charset="utf-8">
+<title>Extrato {{.Cliente}} {{.Periodo}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ccc; padding: .3em .5em; text-align: left; }
+td.valor, th.valor { text-align: right; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Extrato mensal</h1>
+<p>Cliente {{.Cliente}}, período {{.Periodo}} ({{.Inicio}} a {{.Fim}}), fechado em {{.FechadoEm}}</p>
+<table>
+<tr><th>Saldo inicial</th><td class="valor">{{reais .SaldoInicial}}</td></tr>
+<tr><th>Créditos</th><td class="valor">{{reais .TotalCreditos}}</td></tr>
+<tr><th>Débitos</th><td class="valor">{{reais .TotalDebitos}}</td></tr>
+<tr><th>Saldo final</th><td class="valor">{{reais .SaldoFinal}}</td></tr>
+<tr><th>Tarifas</th><td class="valor">{{reais .Tarifas}}</td></tr>
+<tr><th>Juros</th><td class="valor">{{reais .Juros}}</td></tr>
+<tr><th>Limite</th><td class="valor">{{reais .Limite}}</td></tr>
+</table>
+<h2>Transações</h2>
+<table>
+<tr><th>Data</th><th>Descrição</th><th>Tipo</th><th class="valor">Valor</th></tr>
+{{range .Transacoes}}<tr><td>{{.RealizadaEm}}</td><td>{{.Descricao}}</td><td>{{if eq .Tipo "c"}}crédito{{else}}débito{{end}}</td><td class="valor">{{reais .Valor}}</td></tr>
+{{else}}<tr><td colspan="4">Nenhuma transação no período</td></tr>
+{{end}}</table>
+<p>Tarifas e juros são cobrados no fechamento e aparecem no extrato do período seguinte.</p>
+</body>
+</html>
+`))
+
+// monthlyStatementHandler serves the statement as JSON, or as printable HTML when the client accepts text/html
+func monthlyStatementHandler(w http.ResponseWriter, r *http.Request) {
+	accountId := r.PathValue("id")
+	period := r.PathValue("periodo")
+
+	_, _, err := statementCycle(period)
+	if err != nil {
+		validationErr := &ValidationError{}
+		validationErr.add("periodo", ErrInvalidStatementPeriod)
+		writeValidationError(w, validationErr)
+		return
+	}
+	if _, err := strconv.Atoi(accountId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	statement, err := getMonthlyStatement(r.Context(), accountId, period)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to query monthly statement: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		monthlyStatementTemplate.Execute(w, struct {
+			MonthlyStatement
+			Cliente string
+		}{statement, accountId})
+		return
+	}
+
+	b, _ := json.Marshal(statement)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
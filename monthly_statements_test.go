@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatementCycle(t *testing.T) {
+	StatementClosingDay = 10
+	defer func() { StatementClosingDay = 1 }()
+
+	start, end, err := statementCycle("2024-12")
+	if err != nil || !start.Equal(time.Date(2024, 12, 10, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Got %v to %v (error %v), wants 2024-12-10 to 2025-01-10", start, end, err)
+	}
+	for _, period := range []string{"", "2024-13", "2024-1", "dezembro"} {
+		_, _, err := statementCycle(period)
+		if err == nil {
+			t.Errorf("Period %q: got no error, wants one", period)
+		}
+	}
+}
+
+func TestLastClosedPeriod(t *testing.T) {
+	StatementClosingDay = 10
+	defer func() { StatementClosingDay = 1 }()
+
+	cases := []struct {
+		now  time.Time
+		want string
+	}{
+		{time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), "2024-02"},
+		{time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC), "2024-02"},
+		// the transactions started before the end of the cycle may still be committing
+		{time.Date(2024, 3, 10, 0, 30, 0, 0, time.UTC), "2024-01"},
+		{time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC), "2023-11"},
+	}
+
+	for _, c := range cases {
+		got := lastClosedPeriod(c.now)
+		if got != c.want {
+			t.Errorf("Now %v: got %s, wants %s", c.now, got, c.want)
+		}
+	}
+}
+
+func TestStatementInterest(t *testing.T) {
+	StatementInterestRate = 250
+	defer func() { StatementInterestRate = 0 }()
+
+	cases := []struct {
+		balance Money
+		want    Money
+	}{
+		{10000, 0},
+		{0, 0},
+		{-10000, 250},
+		{-333, 8},
+		{-9223372036854775807, 230584300921369395},
+	}
+
+	for _, c := range cases {
+		got := statementInterest(c.balance)
+		if got != c.want {
+			t.Errorf("Balance %d: got %d, wants %d", c.balance, got, c.want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	cases := []struct {
+		money Money
+		want  string
+	}{
+		{0, "0,00"},
+		{5, "0,05"},
+		{-90, "-0,90"},
+		{123456, "1.234,56"},
+		{-100000000, "-1.000.000,00"},
+	}
+
+	for _, c := range cases {
+		got := formatMoney(c.money)
+		if got != c.want {
+			t.Errorf("Money %d: got %s, wants %s", c.money, got, c.want)
+		}
+	}
+}
+
+func TestMonthlyStatementTemplate(t *testing.T) {
+	statement := MonthlyStatement{
+		Periodo:      "2024-03",
+		SaldoInicial: 100000,
+		Transacoes:   []ActivityStatementTransaction{{Valor: 1050, Tipo: "d", Descricao: "<script>", RealizadaEm: "2024-03-05T10:00:00Z"}},
+	}
+	var b strings.Builder
+	err := monthlyStatementTemplate.Execute(&b, struct {
+		MonthlyStatement
+		Cliente string
+	}{statement, "1"})
+
+	html := b.String()
+	if err != nil || !strings.Contains(html, "1.000,00") || !strings.Contains(html, "10,50") || strings.Contains(html, "<script>") {
+		t.Errorf("Got %s (error %v), wants the amounts in reais and the description escaped", html, err)
+	}
+}
+
+func TestMonthlyStatementValidation(t *testing.T) {
+	req := httptest.NewRequest("GET", "/clientes/1/extratos/2024-13", nil)
+	req.SetPathValue("id", "1")
+	req.SetPathValue("periodo", "2024-13")
+	res := httptest.NewRecorder()
+	monthlyStatementHandler(res, req)
+
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Got %d, wants %d", res.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// openapi.json documents the HTTP API. TestOpenAPISpec fails when a route or a request/response struct
+// changes without the document being updated.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+var OpenAPI *OpenAPIDocument // request validation against the spec, nil unless OPENAPI_VALIDATION is true
+
+// OpenAPIDocument holds the parts of the spec needed to validate requests.
+// Only the subset of JSON Schema used by openapi.json is supported.
+type OpenAPIDocument struct {
+	Paths      map[string]map[string]OpenAPIOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*OpenAPISchema   `json:"schemas"`
+		Parameters map[string]OpenAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type OpenAPIOperation struct {
+	Parameters  []OpenAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *OpenAPISchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type OpenAPIParameter struct {
+	Ref      string         `json:"$ref"`
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *OpenAPISchema `json:"schema"`
+}
+
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref"`
+	Type                 string                    `json:"type"`
+	Format               string                    `json:"format"`
+	Required             []string                  `json:"required"`
+	Properties           map[string]*OpenAPISchema `json:"properties"`
+	AdditionalProperties *bool                     `json:"additionalProperties"`
+	Items                *OpenAPISchema            `json:"items"`
+	Enum                 []string                  `json:"enum"`
+	Minimum              *int64                    `json:"minimum"`
+	Maximum              *int64                    `json:"maximum"`
+	MinLength            *int                      `json:"minLength"`
+	MaxLength            *int                      `json:"maxLength"`
+}
+
+func loadOpenAPIDocument() (*OpenAPIDocument, error) {
+	var doc OpenAPIDocument
+	err := json.Unmarshal(openAPISpec, &doc)
+	return &doc, err
+}
+
+func openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+func (d *OpenAPIDocument) schema(s *OpenAPISchema) *OpenAPISchema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+func (d *OpenAPIDocument) parameter(p OpenAPIParameter) OpenAPIParameter {
+	if p.Ref != "" {
+		return d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+// validate appends an error for every constraint of the schema that the value breaks.
+// Numbers have to be decoded with UseNumber, so integers are not mistaken for floats.
+func (d *OpenAPIDocument) validate(s *OpenAPISchema, field string, value any, errs []FieldError) []FieldError {
+	s = d.schema(s)
+	if s == nil {
+		return errs
+	}
+	fail := func(format string, args ...any) []FieldError {
+		return append(errs, FieldError{Campo: field, Mensagem: fmt.Sprintf(format, args...)})
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fail("needs to be an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				errs = append(errs, FieldError{Campo: joinField(field, name), Mensagem: "is required"})
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		slices.Sort(names) // errors in a stable order
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errs = append(errs, FieldError{Campo: joinField(field, name), Mensagem: "is not allowed"})
+				}
+				continue
+			}
+			errs = d.validate(property, joinField(field, name), object[name], errs)
+		}
+		return errs
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fail("needs to be an array")
+		}
+		for i, item := range array {
+			errs = d.validate(s.Items, fmt.Sprintf("%s[%d]", field, i), item, errs)
+		}
+		return errs
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fail("needs to be an integer")
+		}
+		n, err := number.Int64()
+		if err != nil {
+			return fail("needs to be an integer")
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fail("needs to be greater than or equal to %d", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fail("needs to be less than or equal to %d", *s.Maximum)
+		}
+		return errs
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("needs to be a string")
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fail("needs to be one of %s", strings.Join(s.Enum, ", "))
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fail("needs to have at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fail("needs to have at most %d characters", *s.MaxLength)
+		}
+		return errs
+	}
+	return errs
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// validateRequestAgainst returns the errors of the request's path and query parameters and of its JSON body.
+// The body is left untouched for the handler.
+func (d *OpenAPIDocument) validateRequestAgainst(operation OpenAPIOperation, r *http.Request) ([]FieldError, error) {
+	var errs []FieldError
+	for _, p := range operation.Parameters {
+		p = d.parameter(p)
+		var value string
+		switch p.In {
+		case "path":
+			value = r.PathValue(p.Name)
+		case "query":
+			value = r.URL.Query().Get(p.Name)
+		default:
+			continue
+		}
+		if value == "" {
+			if p.Required {
+				errs = append(errs, FieldError{Campo: p.Name, Mensagem: "is required"})
+			}
+			continue
+		}
+		var parsed any = value
+		if s := d.schema(p.Schema); s != nil && s.Type == "integer" {
+			parsed = json.Number(value)
+		}
+		errs = d.validate(p.Schema, p.Name, parsed, errs)
+	}
+
+	if operation.RequestBody == nil {
+		return errs, nil
+	}
+	content, ok := operation.RequestBody.Content["application/json"]
+	if !ok {
+		return errs, nil
+	}
+
+	reqBody, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(reqBody)) == 0 {
+		if operation.RequestBody.Required {
+			errs = append(errs, FieldError{Mensagem: "body is required"})
+		}
+		return errs, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(reqBody))
+	decoder.UseNumber()
+	var body any
+	err = decoder.Decode(&body)
+	if err != nil {
+		return append(errs, FieldError{Mensagem: "body needs to be valid JSON"}), nil
+	}
+	return d.validate(content.Schema, "", body, errs), nil
+}
+
+// no route takes a body larger than the transactions' one
+const maxValidatedBodySize = maxTransactionBodySize
+
+// validateRequest rejects the requests that do not match the operation of the route in the spec with
+// 400 {"erro": "requisicao_invalida", "campos": [...]}, and bodies over maxValidatedBodySize with 413.
+// It does nothing when OPENAPI_VALIDATION is not enabled.
+func validateRequest(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if OpenAPI == nil {
+		return next
+	}
+	method, path, _ := strings.Cut(pattern, " ")
+	operation, ok := OpenAPI.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxValidatedBodySize)
+		errs, err := OpenAPI.validateRequestAgainst(operation, r)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			fmt.Fprintf(os.Stderr, "Request body over %d bytes\n", maxValidatedBodySize)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "requisicao_invalida")
+			return
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, &ValidationError{Campos: errs})
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	doc, err := loadOpenAPIDocument()
+	if err != nil {
+		t.Fatalf("Unable to load openapi.json: %v", err)
+	}
+
+	t.Run("documents every route and nothing else", func(t *testing.T) {
+		routes := map[string]bool{}
+		for _, route := range apiRoutes() {
+			method, path, _ := strings.Cut(route.Pattern, " ")
+			routes[strings.ToLower(method)+" "+path] = true
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("Route %s is not documented", route.Pattern)
+			}
+		}
+
+		for path, operations := range doc.Paths {
+			for method := range operations {
+				if !routes[method+" "+path] {
+					t.Errorf("Documented operation %s %s has no route", strings.ToUpper(method), path)
+				}
+			}
+		}
+	})
+
+	t.Run("schemas have the fields of the structs", func(t *testing.T) {
+		structs := map[string]any{
+			"TransactionRequestBody":          TransactionRequestBody{},
+			"TransactionResponseBody":         TransactionResponseBody{},
+			"ActivityStatementResponseBody":   ActivityStatementResponseBody{},
+			"Saldo":                           Saldo{},
+			"ActivityStatementTransaction":    ActivityStatementTransaction{},
+			"TransactionHistoryResponseBody":  TransactionHistoryResponseBody{},
+			"PointInTimeBalanceResponseBody":  PointInTimeBalanceResponseBody{},
+			"MonthlyStatement":                MonthlyStatement{},
+			"BalanceEvent":                    BalanceEvent{},
+			"BalanceResetEvent":               BalanceResetEvent{},
+			"ErrorResponseBody":               ErrorResponseBody{},
+			"FieldError":                      FieldError{},
+			"WebhookSubscriptionRequestBody":  WebhookSubscriptionRequestBody{},
+			"WebhookSubscriptionResponseBody": WebhookSubscriptionResponseBody{},
+			"ReplayWebhookResponseBody":       ReplayWebhookResponseBody{},
+			"AccountExport":                   AccountExport{},
+			"ExportedAccount":                 ExportedAccount{},
+			"SpendingCaps":                    SpendingCaps{},
+			"ExportedTransaction":             ExportedTransaction{},
+		}
+
+		for name, value := range structs {
+			schema, ok := doc.Components.Schemas[name]
+			if !ok {
+				t.Errorf("Schema %s is not documented", name)
+				continue
+			}
+
+			var fields []string
+			structType := reflect.TypeOf(value)
+			for i := range structType.NumField() {
+				tag, _, _ := strings.Cut(structType.Field(i).Tag.Get("json"), ",")
+				fields = append(fields, tag)
+			}
+			var properties []string
+			for property := range schema.Properties {
+				properties = append(properties, property)
+			}
+			slices.Sort(fields)
+			slices.Sort(properties)
+
+			if !slices.Equal(fields, properties) {
+				t.Errorf("Schema %s: got properties %v, wants %v", name, properties, fields)
+			}
+		}
+	})
+}
+
+func TestValidateRequest(t *testing.T) {
+	doc, err := loadOpenAPIDocument()
+	if err != nil {
+		t.Fatalf("Unable to load openapi.json: %v", err)
+	}
+	OpenAPI = doc
+	defer func() { OpenAPI = nil }()
+
+	handler := validateRequest("POST /clientes/{id}/transacoes", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /clientes/{id}/transacoes", handler)
+
+	tests := []struct {
+		path       string
+		body       string
+		statusCode int
+		fields     []string
+	}{
+		{"/clientes/1/transacoes", `{"valor": 1000, "tipo": "c", "descricao": "descricao"}`, http.StatusOK, nil},
+		{"/clientes/1/transacoes", `{"valor": 1.5, "tipo": "x", "descricao": ""}`, http.StatusBadRequest, []string{"descricao", "tipo", "valor"}},
+		{"/clientes/1/transacoes", `{"valor": "1000", "tipo": "c"}`, http.StatusBadRequest, []string{"descricao", "valor"}},
+		{"/clientes/1/transacoes", `{"valor": 0, "tipo": "c", "descricao": "d", "extra": true}`, http.StatusBadRequest, []string{"extra", "valor"}},
+		{"/clientes/1/transacoes", `not json`, http.StatusBadRequest, []string{""}},
+		{"/clientes/abc/transacoes", `{"valor": 1000, "tipo": "c", "descricao": "descricao"}`, http.StatusBadRequest, []string{"id"}},
+		{"/clientes/1/transacoes", `{"valor": 1000, "tipo": "c", "descricao": "` + strings.Repeat("a", maxValidatedBodySize) + `"}`, http.StatusRequestEntityTooLarge, nil},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.statusCode {
+			t.Errorf("Body %s: got %d, wants %d", tt.body, rr.Code, tt.statusCode)
+			continue
+		}
+		if tt.fields == nil {
+			continue
+		}
+
+		var responseBody ErrorResponseBody
+		json.Unmarshal(rr.Body.Bytes(), &responseBody)
+		var fields []string
+		for _, fieldError := range responseBody.Campos {
+			fields = append(fields, fieldError.Campo)
+		}
+		if responseBody.Erro != "requisicao_invalida" || !slices.Equal(fields, tt.fields) {
+			t.Errorf("Body %s: got %s %v, wants requisicao_invalida %v", tt.body, responseBody.Erro, fields, tt.fields)
+		}
+	}
+}
+
+func TestValidateRequestRunsAfterAuthorization(t *testing.T) {
+	doc, err := loadOpenAPIDocument()
+	if err != nil {
+		t.Fatalf("Unable to load openapi.json: %v", err)
+	}
+	OpenAPI = doc
+	AuthEnabled = true
+	defer func() {
+		OpenAPI = nil
+		AuthEnabled = false
+	}()
+
+	mux := http.NewServeMux()
+	for _, route := range apiRoutes() {
+		mux.HandleFunc(route.Pattern, route.Handler)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/clientes/1/transacoes", strings.NewReader(`not json`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Got %d for an invalid request without an api key, wants %d", rr.Code, http.StatusUnauthorized)
+	}
+}
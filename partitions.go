@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// transactions is partitioned by month (transactions_YYYY_MM, see create_transaction_partitions in seed.sql).
+// Partitions older than the retention are moved by `app archive` to transactions_archive (the default) or to a gzipped
+// CSV file. The API does not read the files: the history, balances, exports and monthly statements whose range reaches
+// a month archived to a file are refused with ErrArchivedToFile (409) instead of leaving its transactions out.
+
+const (
+	transactionPartitionsAhead   = 3 // months with a partition, the current one included
+	partitionMaintenanceInterval = 24 * time.Hour
+
+	ArchiveToTable = "table"
+	ArchiveToFile  = "file"
+)
+
+var (
+	partitionNamePattern = regexp.MustCompile(`^transactions_(\d{4})_(\d{2})$`)
+	ErrArchivedToFile    = errors.New("the period has transactions archived to files, which are no longer read")
+)
+
+type ArchivedPartition struct {
+	Partition    string
+	Start        time.Time
+	End          time.Time
+	Transactions int64
+	File         string
+}
+
+func createTransactionPartitions(ctx context.Context) (int, error) {
+	var created int
+	err := ConnPool.QueryRow(ctx, "SELECT create_transaction_partitions(NOW(), $1);", transactionPartitionsAhead).Scan(&created)
+	return created, err
+}
+
+// maintainTransactionPartitions creates the partitions of the next months, so new transactions never fall in transactions_default
+func maintainTransactionPartitions(ctx context.Context) {
+	ticker := time.NewTicker(partitionMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := createTransactionPartitions(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to create transaction partitions: %v\n", err)
+			}
+		}
+	}
+}
+
+// archivablePartitions lists the monthly partitions that ended before the first day of the month retentionMonths before now
+func archivablePartitions(ctx context.Context, retentionMonths int, now time.Time) ([]ArchivedPartition, error) {
+	now = now.UTC()
+	cutoff := time.Date(now.Year(), now.Month()-time.Month(retentionMonths), 1, 0, 0, 0, 0, time.UTC)
+
+	rows, err := ConnPool.Query(ctx, "SELECT inhrelid::regclass::text FROM pg_inherits WHERE inhparent = 'transactions'::regclass ORDER BY 1;")
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []ArchivedPartition
+	for _, name := range names {
+		match := partitionNamePattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		year, _ := strconv.Atoi(match[1])
+		month, _ := strconv.Atoi(match[2])
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		end := start.AddDate(0, 1, 0)
+		if end.After(cutoff) {
+			continue
+		}
+		partitions = append(partitions, ArchivedPartition{Partition: name, Start: start, End: end})
+	}
+	return partitions, nil
+}
+
+// archiveTransactions moves the partitions older than the retention to the destination, ArchiveToTable or
+// ArchiveToFile (a <partition>.csv.gz in dir). Only the transactions archived to the table are still read by the API.
+func archiveTransactions(ctx context.Context, retentionMonths int, destination, dir string, now time.Time) ([]ArchivedPartition, error) {
+	partitions, err := archivablePartitions(ctx, retentionMonths, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var archived []ArchivedPartition
+	for _, partition := range partitions {
+		partition, err = archivePartition(ctx, partition, destination, dir)
+		if err != nil {
+			return archived, fmt.Errorf("failed to archive %s: %w", partition.Partition, err)
+		}
+		archived = append(archived, partition)
+	}
+	return archived, nil
+}
+
+// archivePartition copies the partition, then detaches and drops it in the same database transaction.
+// Before that, every account with transactions in it gets a snapshot of its balance after its last one,
+// so the event sourced mode never has to replay archived transactions.
+func archivePartition(ctx context.Context, partition ArchivedPartition, destination, dir string) (ArchivedPartition, error) {
+	table := pgx.Identifier{partition.Partition}.Sanitize()
+	columns := "id, account_id, amount, type, description, created_at"
+
+	err := inTransaction(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		// nothing is written to a partition of a past month, so it can be copied without blocking the API
+		switch destination {
+		case ArchiveToTable:
+			tag, err := tx.Exec(ctx, "INSERT INTO transactions_archive ("+columns+") SELECT "+columns+" FROM "+table+";")
+			if err != nil {
+				return err
+			}
+			partition.Transactions = tag.RowsAffected()
+		case ArchiveToFile:
+			partition.File = filepath.Join(dir, partition.Partition+".csv.gz")
+			count, err := exportPartition(ctx, tx, table, columns, partition.File)
+			if err != nil {
+				return err
+			}
+			partition.Transactions = count
+		default:
+			return fmt.Errorf("unknown archive destination %q", destination)
+		}
+
+		// credits and debits wait while the balances are read and the partition is detached.
+		// A deadlock with one of them is retried by inTransaction.
+		_, err := tx.Exec(ctx, "LOCK TABLE transactions, accounts IN SHARE MODE;")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+      INSERT INTO balance_snapshots (account_id, transaction_id, balance)
+      SELECT a.id, p.last_id, a.balance - COALESCE((
+        SELECT SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END)
+        FROM transactions t
+        WHERE t.account_id = a.id AND t.id > p.last_id
+      ), 0)
+      FROM accounts a
+      JOIN (SELECT account_id, MAX(id) AS last_id FROM `+table+` GROUP BY account_id) p ON p.account_id = a.id
+      ON CONFLICT DO NOTHING;`)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot balances: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, "ALTER TABLE transactions DETACH PARTITION "+table+";")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DROP TABLE "+table+";")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "INSERT INTO transaction_archives (partition, range_start, range_end, destination, file, transactions) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6);",
+			partition.Partition, partition.Start, partition.End, destination, partition.File, partition.Transactions)
+		return err
+	})
+	return partition, err
+}
+
+// checkFileArchives returns ErrArchivedToFile when a partition archived to a file overlaps since until before until
+func checkFileArchives(ctx context.Context, db rowQuerier, since, until time.Time) error {
+	var archived bool
+	err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM transaction_archives WHERE destination = 'file' AND range_start < $2 AND range_end > $1);", since, until).Scan(&archived)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrArchivedToFile
+	}
+	return nil
+}
+
+// exportPartition writes the partition as a gzipped CSV with a header, returning how many transactions it has
+func exportPartition(ctx context.Context, tx pgx.Tx, table, columns, path string) (int64, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tag, err := tx.Conn().PgConn().CopyTo(ctx, gz, "COPY (SELECT "+columns+" FROM "+table+" ORDER BY id) TO STDOUT WITH (FORMAT csv, HEADER);")
+	if err != nil {
+		return 0, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return 0, err
+	}
+	// the partition is dropped once the database transaction commits, so the file has to be on disk before
+	err = file.Sync()
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), file.Close()
+}
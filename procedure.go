@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var functionErrorCodes = map[string]error{
+	"not_found":              ErrNotFound,
+	"insufficient_funds":     ErrInsufficientFunds,
+	"unknown_type":           ErrUnknownBankTransactionType,
+	"overflow":               ErrAmountOverflow,
+	"max_debit_amount":       ErrMaxDebitAmount,
+	"max_daily_debit_total":  ErrMaxDailyDebitTotal,
+	"max_hourly_debit_count": ErrMaxHourlyDebitCount,
+}
+
+// executeTransactionFunction applies the credit or debit with the execute_transaction PL/pgSQL function,
+// which does in one round trip what executeCredit/executeDebit, the ledger insert and publishBalanceEvent do in Go
+func executeTransactionFunction(ctx context.Context, accountId string, amount Money, transactionType, description string) (Account, error) {
+	var account Account
+	var errorCode pgtype.Text
+	row := ConnPool.QueryRow(ctx, stmtExecuteTransactionFunc, accountId, amount, transactionType, description)
+	err := row.Scan(&account.Balance, &account.BalanceLimit, &errorCode)
+	if err != nil {
+		return account, err
+	}
+
+	if errorCode.Valid {
+		err, ok := functionErrorCodes[errorCode.String]
+		if !ok {
+			return account, fmt.Errorf("unknown error code %q returned by execute_transaction", errorCode.String)
+		}
+		return account, err
+	}
+	return account, nil
+}
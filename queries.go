@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Names of the queries run by the requests (transactions, statements, rate limiting, rules...), prepared on every
+// connection by prepareQueryCatalog. pgx runs the prepared statement when the name is passed in place of the SQL.
+const (
+	stmtCreditAccount          = "credit_account"
+	stmtAccountExists          = "account_exists"
+	stmtSelectAccountForDebit  = "select_account_for_debit"
+	stmtLockAccountForDebit    = "lock_account_for_debit"
+	stmtDebitAccount           = "debit_account"
+	stmtRecentDebits           = "recent_debits"
+	stmtInsertTransaction      = "insert_transaction"
+	stmtPublishBalanceEvent    = "publish_balance_event"
+	stmtActivityStatement      = "activity_statement"
+	stmtExecuteTransactionFunc = "execute_transaction"
+	stmtLockAccount            = "lock_account"
+	stmtReplayBalance          = "replay_balance"
+	stmtProjectBalance         = "project_balance"
+	stmtInsertSnapshot         = "insert_snapshot"
+	stmtTransactionsBetween    = "transactions_between"
+	stmtTransactionsPage       = "transactions_page"
+	stmtBalanceAt              = "balance_at"
+	stmtConditionalCredit      = "conditional_credit"
+	stmtConditionalDebit       = "conditional_debit"
+	stmtTakeRateLimitToken     = "take_rate_limit_token"
+	stmtInsertRuleDecision     = "insert_rule_decision"
+	stmtRecentDebitCount       = "recent_debit_count"
+	stmtRecentDebitAmounts     = "recent_debit_amounts"
+	stmtRecentDescriptionCount = "recent_description_count"
+	stmtReplicaReplayedLSN     = "replica_replayed_lsn"
+	stmtCurrentLSN             = "current_lsn"
+)
+
+const selectAccountForDebit = `
+    SELECT a.balance, a.balance_limit, c.max_debit_amount, c.max_daily_debit_total, c.max_hourly_debit_count
+    FROM accounts a
+    LEFT JOIN spending_caps c ON c.account_id = a.id
+    WHERE a.id = $1`
+
+// conditionalTransaction applies the credit or debit of conditionalStrategy in a single statement, only when
+// balanceCondition holds. Both queries return whether the account exists, whether it has spending caps, the new
+// balance and limit, and whether the transaction was applied (published).
+func conditionalTransaction(newBalance, balanceCondition string) string {
+	return `
+    WITH account AS (
+      UPDATE accounts SET balance = ` + newBalance + `
+      WHERE id = $1 AND ` + balanceCondition + `
+      RETURNING id, balance, balance_limit
+    ), inserted AS (
+      INSERT INTO transactions (account_id, amount, type, description)
+      SELECT id, $2, $3, $4 FROM account
+      RETURNING id, account_id, created_at
+    ), published AS (
+      SELECT publish_balance_event(t.account_id, $5, balance_event_payload(t.id, t.account_id, $2, $3, $4, t.created_at, a.balance, a.balance_limit))
+      FROM inserted t, account a
+    )
+    SELECT
+      EXISTS (SELECT 1 FROM accounts WHERE id = $1),
+      EXISTS (SELECT 1 FROM spending_caps WHERE account_id = $1),
+      COALESCE((SELECT balance FROM account), 0),
+      COALESCE((SELECT balance_limit FROM account), 0),
+      (SELECT COUNT(*) FROM published);`
+}
+
+type catalogQuery struct {
+	name string
+	sql  string
+}
+
+// queryCatalog is in the order the queries are checked at startup
+var queryCatalog = []catalogQuery{
+	{stmtCreditAccount, "UPDATE accounts SET balance = balance + $1 WHERE id = $2 AND balance <= $3 RETURNING balance, balance_limit;"},
+	{stmtAccountExists, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1);"},
+	{stmtSelectAccountForDebit, selectAccountForDebit + ";"},
+	{stmtLockAccountForDebit, selectAccountForDebit + `
+    FOR UPDATE OF a;`},
+	{stmtDebitAccount, "UPDATE accounts SET balance = balance - $1 WHERE id = $2 RETURNING balance, balance_limit;"},
+	{stmtRecentDebits, `
+    SELECT COALESCE(SUM(amount), 0), COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '1 hour')
+    FROM transactions
+    WHERE account_id = $1 AND type = 'd' AND created_at > NOW() - INTERVAL '24 hours';`},
+	{stmtInsertTransaction, "INSERT INTO transactions (account_id, amount, type, description) VALUES ($1, $2, $3, $4) RETURNING id, account_id, created_at;"},
+	{stmtPublishBalanceEvent, "SELECT publish_balance_event($1, $2, $3);"},
+	{stmtActivityStatement, `
+    SELECT a.balance, a.balance_limit, t.amount, t.type, t.description, t.created_at
+    FROM accounts a
+    LEFT JOIN LATERAL (
+      -- the archive holds older transactions and is only read when the account has less than 10 others:
+      -- the count does not depend on the archive's rows, so it is a one-time filter evaluated before scanning it
+      SELECT * FROM (
+        (SELECT amount, type, description, created_at FROM transactions WHERE account_id = $1 ORDER BY created_at DESC LIMIT 10)
+        UNION ALL
+        (SELECT amount, type, description, created_at FROM transactions_archive
+          WHERE account_id = $1 AND (SELECT COUNT(*) FROM (SELECT 1 FROM transactions WHERE account_id = $1 LIMIT 10) r) < 10
+          ORDER BY created_at DESC LIMIT 10)
+      ) t
+      ORDER BY created_at DESC
+      LIMIT 10
+    ) t ON true
+    WHERE a.id = $1;`},
+	{stmtExecuteTransactionFunc, "SELECT COALESCE(new_balance, 0), COALESCE(new_balance_limit, 0), error_code FROM execute_transaction($1, $2, $3, $4);"},
+	{stmtLockAccount, "SELECT id FROM accounts WHERE id = $1 FOR UPDATE;"},
+	{stmtReplayBalance, `
+    SELECT (COALESCE(s.balance, 0) + COALESCE(e.total, 0))::bigint, e.count,
+      a.balance_limit, c.max_debit_amount, c.max_daily_debit_total, c.max_hourly_debit_count
+    FROM accounts a
+    LEFT JOIN spending_caps c ON c.account_id = a.id
+    LEFT JOIN LATERAL (
+      SELECT transaction_id, balance FROM balance_snapshots
+      WHERE account_id = a.id
+      ORDER BY transaction_id DESC
+      LIMIT 1
+    ) s ON true
+    CROSS JOIN LATERAL (
+      SELECT SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END) AS total, COUNT(*) AS count
+      FROM transactions t
+      WHERE t.account_id = a.id AND t.id > COALESCE(s.transaction_id, 0)
+    ) e
+    WHERE a.id = $1;`},
+	{stmtProjectBalance, "UPDATE accounts SET balance = $1 WHERE id = $2;"},
+	{stmtInsertSnapshot, "INSERT INTO balance_snapshots (account_id, transaction_id, balance) VALUES ($1, $2, $3);"},
+	{stmtTransactionsBetween, `
+    SELECT id, account_id, amount, type, description, created_at
+    FROM transactions
+    WHERE account_id = $1 AND created_at >= $2 AND created_at < $3
+    UNION ALL
+    SELECT id, account_id, amount, type, description, created_at
+    FROM transactions_archive
+    WHERE account_id = $1 AND created_at >= $2 AND created_at < $3
+      -- evaluated once, the archive is only read when a partition of the range was archived to it
+      AND EXISTS (SELECT 1 FROM transaction_archives WHERE destination = 'table' AND range_start < $3 AND range_end > $2)
+    ORDER BY created_at, id;`},
+	// the transactions_between after the cursor ($4, $5), at most $6 of them
+	{stmtTransactionsPage, `
+    SELECT id, account_id, amount, type, description, created_at
+    FROM transactions
+    WHERE account_id = $1 AND created_at >= $2 AND created_at < $3 AND (created_at, id) > ($4, $5)
+    UNION ALL
+    SELECT id, account_id, amount, type, description, created_at
+    FROM transactions_archive
+    WHERE account_id = $1 AND created_at >= $2 AND created_at < $3 AND (created_at, id) > ($4, $5)
+      AND EXISTS (SELECT 1 FROM transaction_archives WHERE destination = 'table' AND range_start < $3 AND range_end > $2)
+    ORDER BY created_at, id
+    LIMIT $6;`},
+	{stmtBalanceAt, `
+    SELECT (COALESCE(c.balance, 0) + COALESCE((
+        SELECT SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END)
+        FROM transactions_all t
+        WHERE t.account_id = a.id
+          AND t.created_at >= COALESCE((c.day + 1)::timestamp AT TIME ZONE 'UTC', '-infinity')
+          AND t.created_at <= $2::timestamptz
+      ), 0))::bigint, l.balance_limit,
+      -- the transactions archived to files are not in the sum
+      EXISTS (
+        SELECT 1 FROM transaction_archives
+        WHERE destination = 'file' AND range_start <= $2::timestamptz
+          AND range_end > COALESCE((c.day + 1)::timestamp AT TIME ZONE 'UTC', '-infinity')
+      )
+    FROM accounts a
+    LEFT JOIN LATERAL (
+      -- the checkpoint of the last day that ended at or before the instant
+      SELECT day, balance FROM balance_checkpoints
+      WHERE account_id = a.id AND day < ($2::timestamptz AT TIME ZONE 'UTC')::date
+      ORDER BY day DESC
+      LIMIT 1
+    ) c ON true
+    LEFT JOIN LATERAL (
+      SELECT balance_limit FROM balance_limit_history
+      WHERE account_id = a.id AND valid_from <= $2::timestamptz
+      ORDER BY valid_from DESC
+      LIMIT 1
+    ) l ON true
+    WHERE a.id = $1;`},
+	// credits only update balances that can take the amount, debits only the ones whose limit allows it
+	{stmtConditionalCredit, conditionalTransaction("balance + $2", fmt.Sprintf("balance <= %d - $2", MaxMoney))},
+	{stmtConditionalDebit, conditionalTransaction("balance - $2", "balance >= $2 - balance_limit AND NOT EXISTS (SELECT 1 FROM spending_caps WHERE account_id = $1)")},
+	{stmtTakeRateLimitToken, `
+    INSERT INTO rate_limit_buckets AS b (account_id, tokens, allowed, updated_at)
+    SELECT $1::integer, $3::float8 - 1, true, NOW()
+    WHERE EXISTS (SELECT 1 FROM accounts WHERE id = $1::integer)
+    ON CONFLICT (account_id) DO UPDATE SET
+      allowed = LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * $2::float8) >= 1,
+      tokens = LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * $2::float8)
+        - CASE WHEN LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::float8 * $2::float8) >= 1 THEN 1 ELSE 0 END,
+      updated_at = NOW()
+    RETURNING allowed, tokens;`},
+	{stmtInsertRuleDecision, `
+    INSERT INTO rule_decisions (account_id, amount, type, description, decision, reasons, shadow_mode)
+    VALUES ($1, $2, $3, $4, $5, $6, $7);`},
+	{stmtRecentDebitCount, `
+    SELECT COUNT(*) FROM transactions
+    WHERE account_id = $1 AND type = 'd' AND created_at > NOW() - make_interval(secs => $2);`},
+	{stmtRecentDebitAmounts, `
+    SELECT COUNT(*), COALESCE(AVG(amount), 0)::float8 FROM (
+      SELECT amount FROM transactions
+      WHERE account_id = $1 AND type = 'd'
+      ORDER BY created_at DESC
+      LIMIT $2
+    ) t;`},
+	{stmtRecentDescriptionCount, `
+    SELECT COUNT(*) FROM transactions
+    WHERE account_id = $1 AND description = $2 AND created_at > NOW() - make_interval(secs => $3);`},
+	// pg_last_wal_replay_lsn is NULL when the server is not a replica
+	{stmtReplicaReplayedLSN, "SELECT COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, false);"},
+	{stmtCurrentLSN, "SELECT pg_current_wal_lsn()::text;"},
+}
+
+// prepareQueryCatalog is the AfterConnect of the pools. It takes one round trip per query, once per connection.
+func prepareQueryCatalog(ctx context.Context, conn *pgx.Conn) error {
+	for _, query := range queryCatalog {
+		_, err := conn.Prepare(ctx, query.name, query.sql)
+		if err != nil {
+			return fmt.Errorf("failed to prepare query %s: %w", query.name, err)
+		}
+	}
+	return nil
+}
+
+// checkQueryCatalog plans every query of the catalog with EXPLAIN (GENERIC_PLAN), so a query that does not match
+// the schema stops the API at startup instead of failing its requests. It uses its own connection, as the pool's
+// would fail in AfterConnect before telling which queries are broken.
+func checkQueryCatalog(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pgx.ConnectConfig(ctx, pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	var errs []error
+	for _, query := range queryCatalog {
+		// the simple protocol sends the parameters' placeholders as they are, which GENERIC_PLAN accepts
+		_, err := conn.PgConn().Exec(ctx, "EXPLAIN (GENERIC_PLAN) "+query.sql).ReadAll()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("query %s: %w", query.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
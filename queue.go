@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+const writeWorkerIdleTimeout = 30 * time.Second
+
+var (
+	WriteQueue         *WriteQueues // set when WRITE_QUEUE_SIZE is greater than 0
+	ErrWriteQueueFull  = errors.New("too many transactions waiting for this account")
+	writeQueueMetrics  = expvar.NewMap("write_queue") // rejected and canceled transactions
+	writeQueueWorkers  = new(expvar.Int)              // accounts with a running worker
+	writeQueueInFlight = new(expvar.Int)              // transactions queued or running
+)
+
+func init() {
+	writeQueueMetrics.Set("workers", writeQueueWorkers)
+	writeQueueMetrics.Set("in_flight", writeQueueInFlight)
+}
+
+// WriteQueues funnels the transactions of each account through a single worker (an actor), so a hot account
+// keeps one connection waiting for its row lock instead of one per request. A worker stops after being idle.
+type WriteQueues struct {
+	size    int
+	mu      sync.Mutex
+	workers map[int]*writeWorker
+}
+
+type writeWorker struct {
+	jobs chan writeJob
+}
+
+type writeJob struct {
+	ctx    context.Context
+	fn     func(ctx context.Context) (Account, error)
+	result chan writeResult
+}
+
+type writeResult struct {
+	account Account
+	err     error
+}
+
+func newWriteQueues(size int) *WriteQueues {
+	return &WriteQueues{size: size, workers: map[int]*writeWorker{}}
+}
+
+// submit queues fn behind the other transactions of the account and waits for its result. It fails right away
+// with ErrWriteQueueFull when the account's queue is full, and stops waiting when ctx is done. A canceled
+// transaction that is still queued is skipped by the worker.
+func (q *WriteQueues) submit(ctx context.Context, accountId int, fn func(ctx context.Context) (Account, error)) (Account, error) {
+	job := writeJob{ctx: ctx, fn: fn, result: make(chan writeResult, 1)}
+
+	// sending while holding the lock guarantees the worker is not stopping for being idle
+	q.mu.Lock()
+	worker, ok := q.workers[accountId]
+	if !ok {
+		worker = &writeWorker{jobs: make(chan writeJob, q.size)}
+		q.workers[accountId] = worker
+		writeQueueWorkers.Add(1)
+		go q.work(accountId, worker)
+	}
+	select {
+	case worker.jobs <- job:
+		q.mu.Unlock()
+	default:
+		q.mu.Unlock()
+		writeQueueMetrics.Add("rejected", 1)
+		return Account{}, ErrWriteQueueFull
+	}
+
+	writeQueueInFlight.Add(1)
+	defer writeQueueInFlight.Add(-1)
+	select {
+	case result := <-job.result:
+		return result.account, result.err
+	case <-ctx.Done():
+		writeQueueMetrics.Add("canceled", 1)
+		return Account{}, ctx.Err()
+	}
+}
+
+func (q *WriteQueues) work(accountId int, worker *writeWorker) {
+	idle := time.NewTimer(writeWorkerIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case job := <-worker.jobs:
+			if job.ctx.Err() != nil {
+				job.result <- writeResult{err: job.ctx.Err()}
+			} else {
+				account, err := job.fn(job.ctx)
+				job.result <- writeResult{account: account, err: err}
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(writeWorkerIdleTimeout)
+		case <-idle.C:
+			q.mu.Lock()
+			if len(worker.jobs) == 0 {
+				delete(q.workers, accountId)
+				writeQueueWorkers.Add(-1)
+				q.mu.Unlock()
+				return
+			}
+			q.mu.Unlock()
+			idle.Reset(writeWorkerIdleTimeout)
+		}
+	}
+}
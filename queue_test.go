@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteQueues(t *testing.T) {
+	t.Run("runs the transactions of an account one at a time and other accounts in parallel", func(t *testing.T) {
+		queues := newWriteQueues(100)
+		var running, maxRunning [2]atomic.Int64
+		var wg sync.WaitGroup
+
+		for i := range 40 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				account := i % 2
+				_, err := queues.submit(context.Background(), account, func(ctx context.Context) (Account, error) {
+					n := running[account].Add(1)
+					if n > maxRunning[account].Load() {
+						maxRunning[account].Store(n)
+					}
+					time.Sleep(time.Millisecond)
+					running[account].Add(-1)
+					return Account{}, nil
+				})
+				if err != nil {
+					t.Errorf("Got error %v, wants none", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for account := range 2 {
+			if got := maxRunning[account].Load(); got != 1 {
+				t.Errorf("Account %d: got %d transactions running at the same time, wants 1", account, got)
+			}
+		}
+	})
+
+	t.Run("rejects transactions when the account's queue is full", func(t *testing.T) {
+		queues := newWriteQueues(1)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		block := func(ctx context.Context) (Account, error) {
+			close(started)
+			<-release
+			return Account{Balance: 10}, nil
+		}
+
+		results := make(chan error, 2)
+		go func() {
+			_, err := queues.submit(context.Background(), 1, block)
+			results <- err
+		}()
+		<-started // the first transaction left the queue and is running
+
+		go func() {
+			_, err := queues.submit(context.Background(), 1, func(ctx context.Context) (Account, error) { return Account{}, nil })
+			results <- err
+		}()
+		for len(queues.workers[1].jobs) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		_, err := queues.submit(context.Background(), 1, func(ctx context.Context) (Account, error) { return Account{}, nil })
+		if err != ErrWriteQueueFull {
+			t.Errorf("Got error %v, wants %v", err, ErrWriteQueueFull)
+		}
+
+		_, err = queues.submit(context.Background(), 2, func(ctx context.Context) (Account, error) { return Account{}, nil })
+		if err != nil {
+			t.Errorf("Got error %v for another account, wants none", err)
+		}
+
+		close(release)
+		for range 2 {
+			if err := <-results; err != nil {
+				t.Errorf("Got error %v, wants none", err)
+			}
+		}
+	})
+
+	t.Run("skips transactions canceled while queued", func(t *testing.T) {
+		queues := newWriteQueues(10)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		go queues.submit(context.Background(), 1, func(ctx context.Context) (Account, error) {
+			close(started)
+			<-release
+			return Account{}, nil
+		})
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		var ran atomic.Bool
+		_, err := queues.submit(ctx, 1, func(ctx context.Context) (Account, error) {
+			ran.Store(true)
+			return Account{}, nil
+		})
+		if err != context.DeadlineExceeded {
+			t.Errorf("Got error %v, wants %v", err, context.DeadlineExceeded)
+		}
+
+		close(release)
+		// the next transaction of the account only runs after the canceled one was skipped
+		_, err = queues.submit(context.Background(), 1, func(ctx context.Context) (Account, error) { return Account{}, nil })
+		if err != nil || ran.Load() {
+			t.Errorf("Got error %v and canceled transaction ran: %t, wants no error and false", err, ran.Load())
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RateLimiter is a token bucket per client id. Buckets are stored in PostgreSQL so that
+// both API replicas share the same budget for a client.
+type RateLimiter struct {
+	Rate  float64 // tokens refilled per second
+	Burst float64 // bucket capacity
+}
+
+var (
+	Limiter            *RateLimiter // nil when RATE_LIMIT_RATE is not set
+	rateLimiterMetrics = expvar.NewMap("rate_limiter")
+	rateLimiterTokens  = expvar.NewMap("rate_limiter_tokens") // tokens left in each client's bucket, only existing clients get one
+	ErrRateLimited     = errors.New("rate limit exceeded")
+)
+
+// takeToken refills the bucket for the time elapsed since its last update and consumes one token if there is one.
+// It is a single statement, so concurrent requests from both replicas are serialized by the row lock.
+// Unknown clients get no bucket and ErrNotFound, so made up ids cannot grow the table.
+func (l *RateLimiter) takeToken(ctx context.Context, accountId int) (allowed bool, tokens float64, err error) {
+	row := ConnPool.QueryRow(ctx, stmtTakeRateLimitToken, accountId, l.Rate, l.Burst)
+	err = row.Scan(&allowed, &tokens)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, 0, ErrNotFound
+	}
+	return allowed, tokens, err
+}
+
+// retryAfter is how many whole seconds it takes for the bucket to have one token again.
+func (l *RateLimiter) retryAfter(tokens float64) int {
+	seconds := int(math.Ceil((1 - tokens) / l.Rate))
+	return max(seconds, 1)
+}
+
+// checkRateLimit takes a token of the client for a request of any API (HTTP, WebSocket, gRPC).
+// It returns ErrRateLimited with the seconds until the next token, or ErrNotFound for unknown clients.
+func checkRateLimit(ctx context.Context, accountId int) (retryAfter int, err error) {
+	if Limiter == nil {
+		return 0, nil
+	}
+
+	allowed, tokens, err := Limiter.takeToken(ctx, accountId)
+	if err == ErrNotFound {
+		rateLimiterMetrics.Add("unknown_client", 1)
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		// fail open, the limiter should not take the API down with it
+		fmt.Fprintf(os.Stderr, "Unable to check rate limit: %v\n", err)
+		rateLimiterMetrics.Add("errors", 1)
+		return 0, nil
+	}
+
+	tokensMetric := new(expvar.Float)
+	tokensMetric.Set(tokens)
+	rateLimiterTokens.Set(strconv.Itoa(accountId), tokensMetric)
+
+	if !allowed {
+		rateLimiterMetrics.Add("rejected", 1)
+		return Limiter.retryAfter(tokens), ErrRateLimited
+	}
+
+	rateLimiterMetrics.Add("allowed", 1)
+	return 0, nil
+}
+
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Limiter == nil {
+			next(w, r)
+			return
+		}
+
+		accountId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		retryAfter, err := checkRateLimit(r.Context(), accountId)
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err == ErrRateLimited {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
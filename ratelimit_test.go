@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimitRunsAfterAuthorization(t *testing.T) {
+	// without an api key the request is refused before the limiter, which would need the database
+	Limiter = &RateLimiter{Rate: 1, Burst: 1}
+	AuthEnabled = true
+	defer func() {
+		Limiter = nil
+		AuthEnabled = false
+	}()
+
+	mux := http.NewServeMux()
+	for _, route := range apiRoutes() {
+		mux.HandleFunc(route.Pattern, route.Handler)
+	}
+
+	for _, path := range []string{"/clientes/1/extrato", "/clientes/1/historico?de=2024-01-01", "/clientes/1/eventos"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d without an api key, wants %d", path, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/clientes/1/transacoes", strings.NewReader(`{"valor": 1, "tipo": "c", "descricao": "d"}`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Got %d for a transaction without an api key, wants %d", rr.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ReadPool       *pgxpool.Pool                   // set when DB_READ_HOSTNAME is set, otherwise reads use ConnPool
+	replicaMetrics = expvar.NewMap("read_replica") // reads served by the replica and by the primary because the replica lagged
+	lsnPattern     = regexp.MustCompile(`^[0-9A-Fa-f]{1,8}/[0-9A-Fa-f]{1,8}$`)
+)
+
+type minLSNKey struct{}
+
+// readYourWrites lets a read require the writes up to the LSN in X-Min-LSN (the X-LSN of a write response).
+// The replica is only used for the read when it has replayed that LSN.
+func readYourWrites(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lsn := r.Header.Get("X-Min-LSN")
+		if lsn == "" {
+			next(w, r)
+			return
+		}
+		if !lsnPattern.MatchString(lsn) {
+			writeErrorResponse(w, http.StatusBadRequest, "lsn_invalido")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), minLSNKey{}, lsn)))
+	}
+}
+
+func minLSN(ctx context.Context) string {
+	lsn, _ := ctx.Value(minLSNKey{}).(string)
+	return lsn
+}
+
+// readPool returns the pool for a read that may be served by the replica. Without a minimum LSN the replica
+// can be behind the primary. If it has not replayed the minimum LSN yet (or cannot tell), the primary is used.
+func readPool(ctx context.Context) *pgxpool.Pool {
+	if ReadPool == nil {
+		return ConnPool
+	}
+	lsn := minLSN(ctx)
+	if lsn == "" {
+		replicaMetrics.Add("replica", 1)
+		return ReadPool
+	}
+
+	var replayed bool
+	err := ReadPool.QueryRow(ctx, stmtReplicaReplayedLSN, lsn).Scan(&replayed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to check the replica's LSN: %v\n", err)
+	}
+	if !replayed {
+		replicaMetrics.Add("primary_fallback", 1)
+		return ConnPool
+	}
+	replicaMetrics.Add("replica", 1)
+	return ReadPool
+}
+
+// currentLSN is the position of the primary's WAL, which is past every transaction committed before the call
+func currentLSN(ctx context.Context) (string, error) {
+	var lsn string
+	err := ConnPool.QueryRow(ctx, stmtCurrentLSN).Scan(&lsn)
+	return lsn, err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	cases := []struct {
+		header     string
+		wantStatus int
+		wantLSN    string
+	}{
+		{"", http.StatusOK, ""},
+		{"0/16B3748", http.StatusOK, "0/16B3748"},
+		{"16B3748", http.StatusBadRequest, ""},
+		{"0/16B3748; DROP", http.StatusBadRequest, ""},
+	}
+
+	for _, c := range cases {
+		var gotLSN string
+		handler := readYourWrites(func(w http.ResponseWriter, r *http.Request) {
+			gotLSN = minLSN(r.Context())
+		})
+		req := httptest.NewRequest("GET", "/clientes/1/extrato", nil)
+		req.Header.Set("X-Min-LSN", c.header)
+		res := httptest.NewRecorder()
+		handler(res, req)
+
+		if res.Code != c.wantStatus || gotLSN != c.wantLSN {
+			t.Errorf("X-Min-LSN %q: got status %d and LSN %q, wants %d and %q", c.header, res.Code, gotLSN, c.wantStatus, c.wantLSN)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+	transactionRetryBaseDelay    = 5 * time.Millisecond
+	transactionRetryMaxDelay     = 200 * time.Millisecond
+)
+
+var (
+	TransactionIsolation   = pgx.ReadCommitted // set by TRANSACTION_ISOLATION, the serializable strategy always uses pgx.Serializable
+	TransactionMaxAttempts = 10                // set by TRANSACTION_MAX_ATTEMPTS
+	ErrTooManyConflicts    = errors.New("transaction kept conflicting with concurrent transactions")
+	transactionRetries     = expvar.NewMap("transaction_retries") // retries by SQLSTATE, and the transactions that gave up
+)
+
+// inTransaction runs fn in a database transaction with the isolation level. Serialization failures and deadlocks
+// roll it back and run fn again after a jittered backoff, up to TransactionMaxAttempts times.
+// fn may run more than once, so it must not have side effects outside of tx (writing the response included).
+func inTransaction(ctx context.Context, isoLevel pgx.TxIsoLevel, fn func(tx pgx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := pgx.BeginTxFunc(ctx, ConnPool, pgx.TxOptions{IsoLevel: isoLevel}, fn)
+
+		var pgErr *pgconn.PgError
+		if !isConflictError(err) || !errors.As(err, &pgErr) {
+			return err
+		}
+		if attempt >= TransactionMaxAttempts {
+			transactionRetries.Add("exhausted", 1)
+			return fmt.Errorf("%w after %d attempts: %w", ErrTooManyConflicts, attempt, err)
+		}
+		transactionRetries.Add(pgErr.Code, 1)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(transactionRetryDelay(attempt)):
+		}
+	}
+}
+
+// isConflictError tells the serialization failures and deadlocks, which inTransaction retries
+func isConflictError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == sqlStateSerializationFailure || pgErr.Code == sqlStateDeadlockDetected)
+}
+
+// transactionRetryDelay is an exponential backoff with full jitter, so the transactions that conflicted
+// do not run again at the same time
+func transactionRetryDelay(attempt int) time.Duration {
+	backoff := transactionRetryBaseDelay
+	for i := 1; i < attempt && backoff < transactionRetryMaxDelay; i++ {
+		backoff *= 2
+	}
+	return rand.N(min(backoff, transactionRetryMaxDelay)) + 1
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTransactionRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 20; attempt++ {
+		for range 100 {
+			delay := transactionRetryDelay(attempt)
+			if delay <= 0 || delay > transactionRetryMaxDelay {
+				t.Fatalf("Attempt %d: got a delay of %s, wants between 0 and %s", attempt, delay, transactionRetryMaxDelay)
+			}
+		}
+	}
+
+	// the backoff grows with the attempts, so the first retry is never longer than the base delay
+	for range 100 {
+		if delay := transactionRetryDelay(1); delay > transactionRetryBaseDelay {
+			t.Fatalf("Got a delay of %s for the first retry, wants at most %s", delay, transactionRetryBaseDelay)
+		}
+	}
+}
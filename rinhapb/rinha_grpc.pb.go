@@ -0,0 +1,214 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: rinha.proto
+
+package rinhapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Rinha_PostTransaction_FullMethodName        = "/rinha.v1.Rinha/PostTransaction"
+	Rinha_GetStatement_FullMethodName           = "/rinha.v1.Rinha/GetStatement"
+	Rinha_StreamStatementHistory_FullMethodName = "/rinha.v1.Rinha/StreamStatementHistory"
+)
+
+// RinhaClient is the client API for Rinha service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RinhaClient interface {
+	PostTransaction(ctx context.Context, in *PostTransactionRequest, opts ...grpc.CallOption) (*PostTransactionResponse, error)
+	GetStatement(ctx context.Context, in *GetStatementRequest, opts ...grpc.CallOption) (*Statement, error)
+	StreamStatementHistory(ctx context.Context, in *StreamStatementHistoryRequest, opts ...grpc.CallOption) (Rinha_StreamStatementHistoryClient, error)
+}
+
+type rinhaClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRinhaClient(cc grpc.ClientConnInterface) RinhaClient {
+	return &rinhaClient{cc}
+}
+
+func (c *rinhaClient) PostTransaction(ctx context.Context, in *PostTransactionRequest, opts ...grpc.CallOption) (*PostTransactionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PostTransactionResponse)
+	err := c.cc.Invoke(ctx, Rinha_PostTransaction_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rinhaClient) GetStatement(ctx context.Context, in *GetStatementRequest, opts ...grpc.CallOption) (*Statement, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Statement)
+	err := c.cc.Invoke(ctx, Rinha_GetStatement_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rinhaClient) StreamStatementHistory(ctx context.Context, in *StreamStatementHistoryRequest, opts ...grpc.CallOption) (Rinha_StreamStatementHistoryClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Rinha_ServiceDesc.Streams[0], Rinha_StreamStatementHistory_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rinhaStreamStatementHistoryClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Rinha_StreamStatementHistoryClient interface {
+	Recv() (*StatementTransaction, error)
+	grpc.ClientStream
+}
+
+type rinhaStreamStatementHistoryClient struct {
+	grpc.ClientStream
+}
+
+func (x *rinhaStreamStatementHistoryClient) Recv() (*StatementTransaction, error) {
+	m := new(StatementTransaction)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RinhaServer is the server API for Rinha service.
+// All implementations must embed UnimplementedRinhaServer
+// for forward compatibility
+type RinhaServer interface {
+	PostTransaction(context.Context, *PostTransactionRequest) (*PostTransactionResponse, error)
+	GetStatement(context.Context, *GetStatementRequest) (*Statement, error)
+	StreamStatementHistory(*StreamStatementHistoryRequest, Rinha_StreamStatementHistoryServer) error
+	mustEmbedUnimplementedRinhaServer()
+}
+
+// UnimplementedRinhaServer must be embedded to have forward compatible implementations.
+type UnimplementedRinhaServer struct {
+}
+
+func (UnimplementedRinhaServer) PostTransaction(context.Context, *PostTransactionRequest) (*PostTransactionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PostTransaction not implemented")
+}
+func (UnimplementedRinhaServer) GetStatement(context.Context, *GetStatementRequest) (*Statement, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatement not implemented")
+}
+func (UnimplementedRinhaServer) StreamStatementHistory(*StreamStatementHistoryRequest, Rinha_StreamStatementHistoryServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamStatementHistory not implemented")
+}
+func (UnimplementedRinhaServer) mustEmbedUnimplementedRinhaServer() {}
+
+// UnsafeRinhaServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RinhaServer will
+// result in compilation errors.
+type UnsafeRinhaServer interface {
+	mustEmbedUnimplementedRinhaServer()
+}
+
+func RegisterRinhaServer(s grpc.ServiceRegistrar, srv RinhaServer) {
+	s.RegisterService(&Rinha_ServiceDesc, srv)
+}
+
+func _Rinha_PostTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PostTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RinhaServer).PostTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rinha_PostTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RinhaServer).PostTransaction(ctx, req.(*PostTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rinha_GetStatement_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatementRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RinhaServer).GetStatement(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rinha_GetStatement_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RinhaServer).GetStatement(ctx, req.(*GetStatementRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rinha_StreamStatementHistory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamStatementHistoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RinhaServer).StreamStatementHistory(m, &rinhaStreamStatementHistoryServer{ServerStream: stream})
+}
+
+type Rinha_StreamStatementHistoryServer interface {
+	Send(*StatementTransaction) error
+	grpc.ServerStream
+}
+
+type rinhaStreamStatementHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *rinhaStreamStatementHistoryServer) Send(m *StatementTransaction) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Rinha_ServiceDesc is the grpc.ServiceDesc for Rinha service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Rinha_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rinha.v1.Rinha",
+	HandlerType: (*RinhaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PostTransaction",
+			Handler:    _Rinha_PostTransaction_Handler,
+		},
+		{
+			MethodName: "GetStatement",
+			Handler:    _Rinha_GetStatement_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamStatementHistory",
+			Handler:       _Rinha_StreamStatementHistory_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rinha.proto",
+}
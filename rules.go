@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Decision string
+
+const (
+	DecisionAllow  Decision = "allow"
+	DecisionReview Decision = "review"
+	DecisionDeny   Decision = "deny"
+)
+
+var ErrTransactionDenied = errors.New("transaction denied by the pre-authorization rules")
+
+// RuleInput is what the rules know about the transaction being authorized.
+type RuleInput struct {
+	AccountId   string
+	Amount      Money
+	Type        string
+	Description string
+}
+
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// TransactionRule is the extension point of the rules engine.
+// Evaluate returns triggered = true and a human readable reason when the transaction matches the rule.
+type TransactionRule interface {
+	Evaluate(ctx context.Context, db rowQuerier, input RuleInput) (triggered bool, reason string, err error)
+}
+
+// RuleConfig is one entry of the rules file. Besides name, type and action, each rule type reads its own fields.
+type RuleConfig struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Action Decision `json:"action"` // 'deny' or 'review' when the rule is triggered
+
+	MaxCount     int      `json:"max_count"`
+	Window       string   `json:"window"` // Go duration, e.g. "10m"
+	Multiplier   float64  `json:"multiplier"`
+	HistorySize  int      `json:"history_size"`
+	MinHistory   int      `json:"min_history"`
+	AccountIds   []string `json:"account_ids"`
+	Descriptions []string `json:"descriptions"`
+}
+
+type RulesConfig struct {
+	ShadowMode bool         `json:"shadow_mode"` // only logs and records decisions, never blocks
+	Rules      []RuleConfig `json:"rules"`
+}
+
+// RuleFactories maps the rule type used in the rules file to its constructor.
+// New rules are plugged in by adding an entry here.
+var RuleFactories = map[string]func(config RuleConfig) (TransactionRule, error){
+	"velocity":             newVelocityRule,
+	"unusual_amount":       newUnusualAmountRule,
+	"repeated_description": newRepeatedDescriptionRule,
+	"deny_list":            newDenyListRule,
+}
+
+type configuredRule struct {
+	name   string
+	action Decision
+	rule   TransactionRule
+}
+
+type RulesEngine struct {
+	ShadowMode bool
+	rules      []configuredRule
+}
+
+type RuleEvaluation struct {
+	Decision Decision
+	Reasons  []string
+}
+
+func loadRulesEngine(path string) (*RulesEngine, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config RulesConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRulesEngine(config)
+}
+
+func newRulesEngine(config RulesConfig) (*RulesEngine, error) {
+	engine := RulesEngine{ShadowMode: config.ShadowMode}
+	for i, ruleConfig := range config.Rules {
+		factory, ok := RuleFactories[ruleConfig.Type]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown rule type %q", i, ruleConfig.Type)
+		}
+
+		if ruleConfig.Action != DecisionDeny && ruleConfig.Action != DecisionReview {
+			return nil, fmt.Errorf("rule %d: action needs to be either deny or review", i)
+		}
+
+		rule, err := factory(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+
+		name := ruleConfig.Name
+		if name == "" {
+			name = ruleConfig.Type
+		}
+		engine.rules = append(engine.rules, configuredRule{name: name, action: ruleConfig.Action, rule: rule})
+	}
+	return &engine, nil
+}
+
+// Evaluate runs every rule. Any triggered deny rule denies the transaction, otherwise any triggered review rule flags it for review.
+func (e *RulesEngine) Evaluate(ctx context.Context, db rowQuerier, input RuleInput) (RuleEvaluation, error) {
+	evaluation := RuleEvaluation{Decision: DecisionAllow, Reasons: []string{}}
+	for _, r := range e.rules {
+		triggered, reason, err := r.rule.Evaluate(ctx, db, input)
+		if err != nil {
+			return evaluation, fmt.Errorf("rule %s: %w", r.name, err)
+		}
+		if !triggered {
+			continue
+		}
+
+		evaluation.Reasons = append(evaluation.Reasons, r.name+": "+reason)
+		if r.action == DecisionDeny || evaluation.Decision == DecisionAllow {
+			evaluation.Decision = r.action
+		}
+	}
+	return evaluation, nil
+}
+
+type ruleOutcomeKey struct{}
+
+// ruleOutcome takes the evaluation made inside the strategy's database transaction back to executeTransaction
+type ruleOutcome struct {
+	evaluation RuleEvaluation
+	evaluated  bool
+}
+
+// checkRules evaluates the pre-authorization rules of a debit. It has to run under the account's row lock
+// (or SERIALIZABLE), so concurrent debits see each other in the recent transactions read by the rules.
+// Only the last evaluation is recorded when the database transaction is retried.
+func checkRules(ctx context.Context, tx pgx.Tx, accountId string, amount Money, description string) error {
+	if Rules == nil {
+		return nil
+	}
+	evaluation, err := Rules.Evaluate(ctx, tx, RuleInput{AccountId: accountId, Amount: amount, Type: "d", Description: description})
+	if err != nil {
+		return fmt.Errorf("failed to evaluate rules: %w", err)
+	}
+	if outcome, ok := ctx.Value(ruleOutcomeKey{}).(*ruleOutcome); ok {
+		outcome.evaluation = evaluation
+		outcome.evaluated = true
+	}
+	if evaluation.Decision == DecisionDeny && !Rules.ShadowMode {
+		return ErrTransactionDenied
+	}
+	return nil
+}
+
+func recordRuleDecision(ctx context.Context, input RuleInput, evaluation RuleEvaluation, shadowMode bool) error {
+	_, err := ConnPool.Exec(ctx, stmtInsertRuleDecision,
+		input.AccountId, input.Amount, input.Type, input.Description, string(evaluation.Decision), evaluation.Reasons, shadowMode)
+	return err
+}
+
+func parseRuleWindow(config RuleConfig) (time.Duration, error) {
+	window, err := time.ParseDuration(config.Window)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window: %w", err)
+	}
+	if window <= 0 {
+		return 0, errors.New("window needs to be positive")
+	}
+	return window, nil
+}
+
+// velocity: too many debits in a short window of time
+type velocityRule struct {
+	maxCount int
+	window   time.Duration
+}
+
+func newVelocityRule(config RuleConfig) (TransactionRule, error) {
+	window, err := parseRuleWindow(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxCount <= 0 {
+		return nil, errors.New("max_count needs to be positive")
+	}
+	return velocityRule{maxCount: config.MaxCount, window: window}, nil
+}
+
+func (r velocityRule) Evaluate(ctx context.Context, db rowQuerier, input RuleInput) (bool, string, error) {
+	var count int
+	row := db.QueryRow(ctx, stmtRecentDebitCount, input.AccountId, r.window.Seconds())
+	err := row.Scan(&count)
+	if err != nil {
+		return false, "", err
+	}
+
+	if count+1 > r.maxCount {
+		return true, fmt.Sprintf("%d debits in the last %s", count+1, r.window), nil
+	}
+	return false, "", nil
+}
+
+// unusual_amount: debit is much bigger than the average of the account's recent debits
+type unusualAmountRule struct {
+	multiplier  float64
+	historySize int
+	minHistory  int
+}
+
+func newUnusualAmountRule(config RuleConfig) (TransactionRule, error) {
+	if config.Multiplier <= 0 {
+		return nil, errors.New("multiplier needs to be positive")
+	}
+	if config.HistorySize <= 0 {
+		return nil, errors.New("history_size needs to be positive")
+	}
+	return unusualAmountRule{multiplier: config.Multiplier, historySize: config.HistorySize, minHistory: config.MinHistory}, nil
+}
+
+func (r unusualAmountRule) Evaluate(ctx context.Context, db rowQuerier, input RuleInput) (bool, string, error) {
+	var count int
+	var average float64
+	row := db.QueryRow(ctx, stmtRecentDebitAmounts, input.AccountId, r.historySize)
+	err := row.Scan(&count, &average)
+	if err != nil {
+		return false, "", err
+	}
+
+	if count > 0 && count >= r.minHistory && float64(input.Amount) > average*r.multiplier {
+		return true, fmt.Sprintf("amount %d is above %.1fx the average of %.2f", input.Amount, r.multiplier, average), nil
+	}
+	return false, "", nil
+}
+
+// repeated_description: the same description used too many times in a window of time
+type repeatedDescriptionRule struct {
+	maxCount int
+	window   time.Duration
+}
+
+func newRepeatedDescriptionRule(config RuleConfig) (TransactionRule, error) {
+	window, err := parseRuleWindow(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxCount <= 0 {
+		return nil, errors.New("max_count needs to be positive")
+	}
+	return repeatedDescriptionRule{maxCount: config.MaxCount, window: window}, nil
+}
+
+func (r repeatedDescriptionRule) Evaluate(ctx context.Context, db rowQuerier, input RuleInput) (bool, string, error) {
+	var count int
+	row := db.QueryRow(ctx, stmtRecentDescriptionCount, input.AccountId, input.Description, r.window.Seconds())
+	err := row.Scan(&count)
+	if err != nil {
+		return false, "", err
+	}
+
+	if count+1 > r.maxCount {
+		return true, fmt.Sprintf("description %q used %d times in the last %s", input.Description, count+1, r.window), nil
+	}
+	return false, "", nil
+}
+
+// deny_list: blocked accounts or descriptions (case insensitive).
+// Account ids are compared as numbers, so "02" from the path is the deny-listed "2".
+type denyListRule struct {
+	accountIds   []int
+	descriptions []string
+}
+
+func newDenyListRule(config RuleConfig) (TransactionRule, error) {
+	accountIds := make([]int, len(config.AccountIds))
+	for i, accountId := range config.AccountIds {
+		id, err := strconv.Atoi(accountId)
+		if err != nil {
+			return nil, fmt.Errorf("account id %q needs to be an integer", accountId)
+		}
+		accountIds[i] = id
+	}
+	descriptions := make([]string, len(config.Descriptions))
+	for i, description := range config.Descriptions {
+		descriptions[i] = strings.ToLower(description)
+	}
+	return denyListRule{accountIds: accountIds, descriptions: descriptions}, nil
+}
+
+func (r denyListRule) Evaluate(_ context.Context, _ rowQuerier, input RuleInput) (bool, string, error) {
+	if id, err := strconv.Atoi(input.AccountId); err == nil && slices.Contains(r.accountIds, id) {
+		return true, fmt.Sprintf("account %d is deny-listed", id), nil
+	}
+	if slices.Contains(r.descriptions, strings.ToLower(input.Description)) {
+		return true, fmt.Sprintf("description %q is deny-listed", input.Description), nil
+	}
+	return false, "", nil
+}
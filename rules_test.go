@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRulesEngine(t *testing.T) {
+	t.Run("rejects unknown rule types and actions", func(t *testing.T) {
+		configs := []RulesConfig{
+			{Rules: []RuleConfig{{Type: "unknown", Action: DecisionDeny}}},
+			{Rules: []RuleConfig{{Type: "deny_list", Action: DecisionAllow}}},
+			{Rules: []RuleConfig{{Type: "velocity", Action: DecisionDeny, MaxCount: 1, Window: "not a duration"}}},
+		}
+
+		for _, config := range configs {
+			_, err := newRulesEngine(config)
+			if err == nil {
+				t.Errorf("Got no error for config %+v", config)
+			}
+		}
+	})
+
+	t.Run("deny wins over review and every triggered rule is a reason", func(t *testing.T) {
+		engine, err := newRulesEngine(RulesConfig{Rules: []RuleConfig{
+			{Name: "review_desc", Type: "deny_list", Action: DecisionReview, Descriptions: []string{"PIX"}},
+			{Name: "deny_account", Type: "deny_list", Action: DecisionDeny, AccountIds: []string{"3"}},
+		}})
+		if err != nil {
+			t.Fatalf("Unable to create engine: %v\n", err)
+		}
+
+		got, err := engine.Evaluate(context.Background(), nil, RuleInput{AccountId: "3", Amount: 10, Type: "d", Description: "pix"})
+		if err != nil {
+			t.Fatalf("Unable to evaluate rules: %v\n", err)
+		}
+
+		if got.Decision != DecisionDeny || len(got.Reasons) != 2 {
+			t.Errorf("Got decision %s with reasons %v, wants %s with 2 reasons", got.Decision, got.Reasons, DecisionDeny)
+		}
+
+		got, _ = engine.Evaluate(context.Background(), nil, RuleInput{AccountId: "1", Amount: 10, Type: "d", Description: "Desc."})
+		if got.Decision != DecisionAllow || len(got.Reasons) != 0 {
+			t.Errorf("Got decision %s with reasons %v, wants %s without reasons", got.Decision, got.Reasons, DecisionAllow)
+		}
+
+		got, _ = engine.Evaluate(context.Background(), nil, RuleInput{AccountId: "03", Amount: 10, Type: "d", Description: "Desc."})
+		if got.Decision != DecisionDeny {
+			t.Errorf("Got decision %s for account 03, wants %s", got.Decision, DecisionDeny)
+		}
+	})
+
+	t.Run("deny list needs integer account ids", func(t *testing.T) {
+		_, err := newRulesEngine(RulesConfig{Rules: []RuleConfig{{Type: "deny_list", Action: DecisionDeny, AccountIds: []string{"abc"}}}})
+		if err == nil {
+			t.Errorf("Got no error for account id abc, wants one")
+		}
+	})
+}
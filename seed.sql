@@ -4,8 +4,8 @@ DROP TABLE IF EXISTS accounts CASCADE;
 CREATE TABLE IF NOT EXISTS accounts (
   id SERIAL NOT NULL,
   name VARCHAR NOT NULL,
-  balance INTEGER DEFAULT 0 NOT NULL,
-  balance_limit INTEGER DEFAULT 0 NOT NULL,
+  balance BIGINT DEFAULT 0 NOT NULL,
+  balance_limit BIGINT DEFAULT 0 NOT NULL,
   created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
   PRIMARY KEY(id)
 );
@@ -19,16 +19,69 @@ VALUES
   ('Bruce Wayne', 100000*100),
   ('Scarlett Johansson', 5000*100);
 
--- Create transactions
+-- Create transactions, partitioned by month of created_at (the primary key has to include it).
+-- transactions_default only takes transactions of months without a partition.
 DROP TABLE IF EXISTS transactions CASCADE;
 
 CREATE TABLE IF NOT EXISTS transactions (
   id SERIAL NOT NULL,
   account_id INTEGER NOT NULL,
-  amount INTEGER NOT NULL,
+  amount BIGINT NOT NULL,
   type VARCHAR NOT NULL,
   description VARCHAR NOT NULL,
   created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id, created_at),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+) PARTITION BY RANGE (created_at);
+
+CREATE INDEX transactions_account_id_created_at_desc_idx ON transactions(account_id, created_at DESC);
+
+CREATE TABLE transactions_default PARTITION OF transactions DEFAULT;
+
+-- Create the function creating the monthly partitions (transactions_YYYY_MM, in UTC) of p_months months from p_from.
+-- Called by the API at startup and daily, returns how many partitions were created.
+DROP FUNCTION IF EXISTS create_transaction_partitions;
+
+CREATE FUNCTION create_transaction_partitions(p_from TIMESTAMPTZ, p_months INTEGER) RETURNS INTEGER AS $$
+DECLARE
+  v_start TIMESTAMPTZ;
+  v_name TEXT;
+  v_created INTEGER := 0;
+BEGIN
+  -- the API replicas call it at the same time
+  PERFORM pg_advisory_xact_lock(hashtext('create_transaction_partitions'));
+
+  FOR i IN 0..p_months - 1 LOOP
+    v_start := (date_trunc('month', p_from AT TIME ZONE 'UTC') + make_interval(months => i)) AT TIME ZONE 'UTC';
+    v_name := 'transactions_' || to_char(v_start AT TIME ZONE 'UTC', 'YYYY_MM');
+    CONTINUE WHEN to_regclass(v_name) IS NOT NULL;
+
+    EXECUTE format(
+      'CREATE TABLE %I PARTITION OF transactions FOR VALUES FROM (%L) TO (%L)',
+      v_name, v_start, (v_start AT TIME ZONE 'UTC' + INTERVAL '1 month') AT TIME ZONE 'UTC'
+    );
+    v_created := v_created + 1;
+  END LOOP;
+  RETURN v_created;
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT create_transaction_partitions(NOW(), 3);
+
+-- Create the archive of the transaction partitions older than the retention (see `app archive`),
+-- and the log of the archived partitions
+DROP TABLE IF EXISTS transactions_archive CASCADE;
+
+CREATE TABLE IF NOT EXISTS transactions_archive (
+  id INTEGER NOT NULL,
+  account_id INTEGER NOT NULL,
+  amount BIGINT NOT NULL,
+  type VARCHAR NOT NULL,
+  description VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
   PRIMARY KEY(id),
   CONSTRAINT fk_account
     FOREIGN KEY(account_id)
@@ -36,6 +89,444 @@ CREATE TABLE IF NOT EXISTS transactions (
       ON DELETE CASCADE
 );
 
-CREATE INDEX transactions_account_id_created_at_desc_idx ON transactions(account_id, created_at DESC);
+CREATE INDEX transactions_archive_account_id_created_at_desc_idx ON transactions_archive(account_id, created_at DESC);
+
+DROP TABLE IF EXISTS transaction_archives CASCADE;
+
+CREATE TABLE IF NOT EXISTS transaction_archives (
+  partition VARCHAR NOT NULL,
+  range_start TIMESTAMPTZ NOT NULL,
+  range_end TIMESTAMPTZ NOT NULL,
+  destination VARCHAR NOT NULL, -- 'table' (transactions_archive) or 'file'
+  file VARCHAR,
+  transactions INTEGER NOT NULL,
+  archived_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(partition)
+);
+
+-- Create the view of every transaction, archived or not
+CREATE VIEW transactions_all AS
+  SELECT id, account_id, amount, type, description, created_at FROM transactions
+  UNION ALL
+  SELECT id, account_id, amount, type, description, created_at FROM transactions_archive;
+
+-- Create balance snapshots of TRANSACTION_MODE=event_sourced: the balance of the account after transaction_id,
+-- so the balance is replayed from the last snapshot instead of from the first transaction
+DROP TABLE IF EXISTS balance_snapshots CASCADE;
+
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+  account_id INTEGER NOT NULL,
+  transaction_id INTEGER NOT NULL,
+  balance BIGINT NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(account_id, transaction_id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create daily balance checkpoints: the balance of the account at the end of day (UTC), so a past balance
+-- is the last checkpoint before it plus the transactions after the checkpoint
+DROP TABLE IF EXISTS balance_checkpoints CASCADE;
+
+CREATE TABLE IF NOT EXISTS balance_checkpoints (
+  account_id INTEGER NOT NULL,
+  day DATE NOT NULL,
+  balance BIGINT NOT NULL,
+  PRIMARY KEY(account_id, day),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create the history of the balance limits, recorded by the accounts_balance_limit_history trigger
+DROP TABLE IF EXISTS balance_limit_history CASCADE;
+
+CREATE TABLE IF NOT EXISTS balance_limit_history (
+  account_id INTEGER NOT NULL,
+  balance_limit BIGINT NOT NULL,
+  valid_from TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(account_id, valid_from),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create the monthly statements closed on STATEMENT_CLOSING_DAY, immutable once inserted (see the
+-- monthly_statements_immutable trigger), so accounts with statements cannot be deleted either.
+-- transactions is the list of the period as served by the API.
+DROP TABLE IF EXISTS monthly_statements CASCADE;
+
+CREATE TABLE IF NOT EXISTS monthly_statements (
+  account_id INTEGER NOT NULL,
+  period CHAR(7) NOT NULL, -- 'YYYY-MM', the month the cycle starts
+  period_start TIMESTAMPTZ NOT NULL,
+  period_end TIMESTAMPTZ NOT NULL,
+  opening_balance BIGINT NOT NULL,
+  total_credits BIGINT NOT NULL,
+  total_debits BIGINT NOT NULL,
+  closing_balance BIGINT NOT NULL,
+  fees BIGINT NOT NULL,
+  interest BIGINT NOT NULL,
+  balance_limit BIGINT NOT NULL,
+  transactions JSONB NOT NULL,
+  closed_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(account_id, period),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+);
+
+-- Create spending caps (NULL means the cap is disabled)
+DROP TABLE IF EXISTS spending_caps CASCADE;
+
+CREATE TABLE IF NOT EXISTS spending_caps (
+  account_id INTEGER NOT NULL,
+  max_debit_amount BIGINT,
+  max_daily_debit_total BIGINT,
+  max_hourly_debit_count INTEGER,
+  PRIMARY KEY(account_id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+-- Create decisions of the pre-authorization rules
+DROP TABLE IF EXISTS rule_decisions CASCADE;
+
+CREATE TABLE IF NOT EXISTS rule_decisions (
+  id SERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  amount BIGINT NOT NULL,
+  type VARCHAR NOT NULL,
+  description VARCHAR NOT NULL,
+  decision VARCHAR NOT NULL,
+  reasons TEXT[] NOT NULL,
+  shadow_mode BOOLEAN NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id)
+);
+
+CREATE INDEX rule_decisions_account_id_created_at_desc_idx ON rule_decisions(account_id, created_at DESC);
+
+-- Create token buckets of the rate limiter, shared by the API replicas
+DROP TABLE IF EXISTS rate_limit_buckets CASCADE;
+
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+  account_id INTEGER NOT NULL,
+  tokens DOUBLE PRECISION NOT NULL,
+  allowed BOOLEAN NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY(account_id)
+);
+
+-- Create api keys, only the SHA-256 of the key is stored
+DROP TABLE IF EXISTS api_keys CASCADE;
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL NOT NULL,
+  name VARCHAR NOT NULL,
+  key_hash CHAR(64) NOT NULL,
+  scopes TEXT[] NOT NULL,
+  account_ids INTEGER[], -- NULL means every account
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  revoked_at TIMESTAMPTZ,
+  PRIMARY KEY(id),
+  UNIQUE(key_hash)
+);
+
+-- Create partner secrets used to sign requests, a partner can have more than one active secret while rotating them
+DROP TABLE IF EXISTS partner_secrets CASCADE;
+
+CREATE TABLE IF NOT EXISTS partner_secrets (
+  id SERIAL NOT NULL,
+  partner_id VARCHAR NOT NULL,
+  secret VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  expires_at TIMESTAMPTZ,
+  PRIMARY KEY(id)
+);
+
+CREATE INDEX partner_secrets_partner_id_idx ON partner_secrets(partner_id);
+
+-- Create nonces of signed requests to protect against replays
+DROP TABLE IF EXISTS request_nonces CASCADE;
+
+CREATE TABLE IF NOT EXISTS request_nonces (
+  partner_id VARCHAR NOT NULL,
+  nonce VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(partner_id, nonce)
+);
+
+-- Create webhook subscriptions and the transactional outbox feeding them
+DROP TABLE IF EXISTS webhook_subscriptions CASCADE;
+
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+  id SERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  url VARCHAR NOT NULL,
+  secret VARCHAR NOT NULL,
+  active BOOLEAN DEFAULT true NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id),
+  CONSTRAINT fk_account
+    FOREIGN KEY(account_id)
+      REFERENCES accounts(id)
+      ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_subscriptions_account_id_idx ON webhook_subscriptions(account_id) WHERE active;
+
+DROP TABLE IF EXISTS outbox_events CASCADE;
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+  id BIGSERIAL NOT NULL,
+  account_id INTEGER NOT NULL,
+  event_type VARCHAR NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY(id)
+);
+
+DROP TABLE IF EXISTS webhook_deliveries CASCADE;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id BIGSERIAL NOT NULL,
+  event_id BIGINT NOT NULL,
+  subscription_id INTEGER NOT NULL,
+  status VARCHAR DEFAULT 'pending' NOT NULL, -- 'pending', 'delivered' or 'dead'
+  attempts INTEGER DEFAULT 0 NOT NULL,
+  next_attempt_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  last_error TEXT,
+  delivered_at TIMESTAMPTZ,
+  PRIMARY KEY(id),
+  CONSTRAINT fk_event
+    FOREIGN KEY(event_id)
+      REFERENCES outbox_events(id)
+      ON DELETE CASCADE,
+  CONSTRAINT fk_subscription
+    FOREIGN KEY(subscription_id)
+      REFERENCES webhook_subscriptions(id)
+      ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+-- Create the function publishing balance events, shared by every transaction mode.
+-- Writes the outbox event and its webhook deliveries (only when the account has active subscriptions)
+-- and, when the session sets app.notify_balance_events (BALANCE_EVENTS), notifies the balance_events channel
+-- (balanceEventsChannel), delivered only if the transaction commits.
+CREATE OR REPLACE FUNCTION publish_balance_event(p_account_id INTEGER, p_event_type VARCHAR, p_payload JSONB)
+RETURNS VOID AS $$
+  WITH event AS (
+    INSERT INTO outbox_events (account_id, event_type, payload)
+    SELECT p_account_id, p_event_type, p_payload
+    WHERE EXISTS (SELECT 1 FROM webhook_subscriptions WHERE account_id = p_account_id AND active)
+    RETURNING id, account_id
+  ), deliveries AS (
+    INSERT INTO webhook_deliveries (event_id, subscription_id)
+    SELECT event.id, s.id
+    FROM event
+    JOIN webhook_subscriptions s ON s.account_id = event.account_id AND s.active
+  )
+  SELECT pg_notify('balance_events', p_payload::text)
+  WHERE current_setting('app.notify_balance_events', true) = 'on';
+$$ LANGUAGE sql;
+
+-- Create the function building the payload of a balance event, the same JSON as BalanceEvent
+CREATE OR REPLACE FUNCTION balance_event_payload(
+  p_transaction_id INTEGER,
+  p_account_id INTEGER,
+  p_amount BIGINT,
+  p_type VARCHAR,
+  p_description VARCHAR,
+  p_created_at TIMESTAMPTZ,
+  p_balance BIGINT,
+  p_balance_limit BIGINT
+) RETURNS JSONB AS $$
+  SELECT jsonb_build_object(
+    'transacao_id', p_transaction_id,
+    'cliente_id', p_account_id,
+    'valor', p_amount,
+    'tipo', p_type,
+    'descricao', p_description,
+    'realizada_em', to_char(p_created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+    'saldo', p_balance,
+    'limite', p_balance_limit
+  );
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Create the function used by TRANSACTION_MODE=function: the credit or debit, the spending caps,
+-- the ledger insert and the balance event in a single call. Failures return an error_code instead of raising.
+DROP FUNCTION IF EXISTS execute_transaction;
+
+CREATE FUNCTION execute_transaction(
+  p_account_id INTEGER,
+  p_amount BIGINT,
+  p_type VARCHAR,
+  p_description VARCHAR,
+  OUT new_balance BIGINT,
+  OUT new_balance_limit BIGINT,
+  OUT error_code VARCHAR
+) AS $$
+DECLARE
+  v_max_debit_amount BIGINT;
+  v_max_daily_debit_total BIGINT;
+  v_max_hourly_debit_count INTEGER;
+  v_daily_total NUMERIC;
+  v_hourly_count BIGINT;
+  v_transaction_id INTEGER;
+  v_created_at TIMESTAMPTZ;
+BEGIN
+  IF p_type = 'c' THEN
+    -- only balances that can take the amount are updated, so the sum never goes out of the bigint range
+    UPDATE accounts SET balance = balance + p_amount
+    WHERE id = p_account_id AND balance <= 9223372036854775807 - p_amount
+    RETURNING balance, balance_limit INTO new_balance, new_balance_limit;
+
+    IF NOT FOUND THEN
+      IF EXISTS (SELECT 1 FROM accounts WHERE id = p_account_id) THEN
+        error_code := 'overflow';
+      ELSE
+        error_code := 'not_found';
+      END IF;
+      RETURN;
+    END IF;
+  ELSIF p_type = 'd' THEN
+    SELECT a.balance, a.balance_limit, c.max_debit_amount, c.max_daily_debit_total, c.max_hourly_debit_count
+    INTO new_balance, new_balance_limit, v_max_debit_amount, v_max_daily_debit_total, v_max_hourly_debit_count
+    FROM accounts a
+    LEFT JOIN spending_caps c ON c.account_id = a.id
+    WHERE a.id = p_account_id
+    FOR UPDATE OF a;
+
+    IF NOT FOUND THEN
+      error_code := 'not_found';
+      RETURN;
+    END IF;
+
+    IF new_balance < -9223372036854775808 + p_amount THEN
+      error_code := 'overflow';
+      RETURN;
+    END IF;
+
+    IF new_balance - p_amount < -new_balance_limit THEN
+      error_code := 'insufficient_funds';
+      RETURN;
+    END IF;
+
+    IF v_max_debit_amount IS NOT NULL AND p_amount > v_max_debit_amount THEN
+      error_code := 'max_debit_amount';
+      RETURN;
+    END IF;
+
+    IF v_max_daily_debit_total IS NOT NULL OR v_max_hourly_debit_count IS NOT NULL THEN
+      SELECT COALESCE(SUM(amount), 0), COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '1 hour')
+      INTO v_daily_total, v_hourly_count
+      FROM transactions
+      WHERE account_id = p_account_id AND type = 'd' AND created_at > NOW() - INTERVAL '24 hours';
+
+      IF v_max_daily_debit_total IS NOT NULL AND v_daily_total + p_amount > v_max_daily_debit_total THEN
+        error_code := 'max_daily_debit_total';
+        RETURN;
+      END IF;
+
+      IF v_max_hourly_debit_count IS NOT NULL AND v_hourly_count + 1 > v_max_hourly_debit_count THEN
+        error_code := 'max_hourly_debit_count';
+        RETURN;
+      END IF;
+    END IF;
+
+    UPDATE accounts SET balance = balance - p_amount
+    WHERE id = p_account_id
+    RETURNING balance, balance_limit INTO new_balance, new_balance_limit;
+  ELSE
+    error_code := 'unknown_type';
+    RETURN;
+  END IF;
+
+  INSERT INTO transactions (account_id, amount, type, description)
+  VALUES (p_account_id, p_amount, p_type, p_description)
+  RETURNING id, created_at INTO v_transaction_id, v_created_at;
+
+  PERFORM publish_balance_event(p_account_id, 'transacao.criada', balance_event_payload(
+    v_transaction_id, p_account_id, p_amount, p_type, p_description, v_created_at, new_balance, new_balance_limit
+  ));
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Create the trigger recording the balance limit of new accounts (from their creation) and its changes
+DROP FUNCTION IF EXISTS record_balance_limit CASCADE;
+
+CREATE FUNCTION record_balance_limit() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND OLD.balance_limit = NEW.balance_limit THEN
+    RETURN NEW;
+  END IF;
+
+  INSERT INTO balance_limit_history (account_id, balance_limit, valid_from)
+  VALUES (NEW.id, NEW.balance_limit, CASE WHEN TG_OP = 'INSERT' THEN NEW.created_at ELSE NOW() END)
+  ON CONFLICT (account_id, valid_from) DO UPDATE SET balance_limit = EXCLUDED.balance_limit;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER accounts_balance_limit_history
+  AFTER INSERT OR UPDATE OF balance_limit ON accounts
+  FOR EACH ROW EXECUTE FUNCTION record_balance_limit();
+
+-- the accounts above were inserted before the trigger
+INSERT INTO balance_limit_history (account_id, balance_limit, valid_from)
+SELECT id, balance_limit, created_at FROM accounts;
+
+-- Create the function taking the checkpoints of p_day: the last checkpoint of the account before it (or 0)
+-- plus the transactions until the end of the day. Called by the API for the days that ended, returns how many were taken.
+DROP FUNCTION IF EXISTS create_balance_checkpoints;
+
+CREATE FUNCTION create_balance_checkpoints(p_day DATE) RETURNS INTEGER AS $$
+DECLARE
+  v_created INTEGER;
+BEGIN
+  INSERT INTO balance_checkpoints (account_id, day, balance)
+  SELECT a.id, p_day, COALESCE(c.balance, 0) + COALESCE((
+    SELECT SUM(CASE WHEN t.type = 'c' THEN t.amount ELSE -t.amount END)
+    FROM transactions_all t
+    WHERE t.account_id = a.id
+      AND t.created_at >= COALESCE((c.day + 1)::timestamp AT TIME ZONE 'UTC', '-infinity')
+      AND t.created_at < (p_day + 1)::timestamp AT TIME ZONE 'UTC'
+  ), 0)
+  FROM accounts a
+  LEFT JOIN LATERAL (
+    SELECT day, balance FROM balance_checkpoints
+    WHERE account_id = a.id AND day < p_day
+    ORDER BY day DESC
+    LIMIT 1
+  ) c ON true
+  WHERE a.created_at < (p_day + 1)::timestamp AT TIME ZONE 'UTC'
+  ON CONFLICT DO NOTHING;
+
+  GET DIAGNOSTICS v_created = ROW_COUNT;
+  RETURN v_created;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Create the trigger keeping the monthly statements immutable
+DROP FUNCTION IF EXISTS reject_monthly_statement_change CASCADE;
+
+CREATE FUNCTION reject_monthly_statement_change() RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'monthly statements are immutable' USING ERRCODE = 'integrity_constraint_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER monthly_statements_immutable
+  BEFORE UPDATE OR DELETE ON monthly_statements
+  FOR EACH ROW EXECUTE FUNCTION reject_monthly_statement_change();
 
 COMMIT;
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Partners sign POST /clientes/{id}/transacoes with HMAC-SHA256 over
+//
+//	METHOD \n PATH \n X-Timestamp \n X-Nonce \n BODY
+//
+// using one of their active secrets, sending the hex signature in X-Signature and their id in X-Partner-Id.
+var (
+	SigningEnabled  bool              // set by SIGNING_ENABLED
+	SignatureWindow = 5 * time.Minute // max clock difference accepted, nonces are kept for this long
+
+	ErrSignatureRequired = errors.New("transactions have to be signed, which is only possible over HTTP")
+)
+
+// the signed routes are the transactions', whose handler has the same limit
+const maxSignedBodySize = maxTransactionBodySize
+
+func signRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// activePartnerSecrets returns every secret that is still valid. During a rotation the previous secret
+// keeps working until it expires, so partners can switch without downtime.
+func activePartnerSecrets(ctx context.Context, partnerId string) ([]string, error) {
+	rows, err := ConnPool.Query(ctx, "SELECT secret FROM partner_secrets WHERE partner_id = $1 AND (expires_at IS NULL OR expires_at > NOW());", partnerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for rows.Next() {
+		var secret string
+		err = rows.Scan(&secret)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, rows.Err()
+}
+
+// addPartnerSecret creates a new secret for the partner. Previous secrets expire after the grace period.
+func addPartnerSecret(ctx context.Context, partnerId string, gracePeriod time.Duration) (int, string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return 0, "", err
+	}
+	secret := hex.EncodeToString(raw)
+
+	var id int
+	err = ConnPool.QueryRow(ctx, `
+    WITH expired AS (
+      UPDATE partner_secrets SET expires_at = NOW() + make_interval(secs => $3)
+      WHERE partner_id = $1 AND (expires_at IS NULL OR expires_at > NOW() + make_interval(secs => $3))
+    )
+    INSERT INTO partner_secrets (partner_id, secret) VALUES ($1, $2) RETURNING id;`, partnerId, secret, gracePeriod.Seconds()).Scan(&id)
+	return id, secret, err
+}
+
+func expirePartnerSecret(ctx context.Context, id int) error {
+	tag, err := ConnPool.Exec(ctx, "UPDATE partner_secrets SET expires_at = NOW() WHERE id = $1 AND (expires_at IS NULL OR expires_at > NOW());", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no active partner secret with id %d", id)
+	}
+	return nil
+}
+
+// storeNonce returns false when the nonce was already used by the partner
+func storeNonce(ctx context.Context, partnerId, nonce string) (bool, error) {
+	tag, err := ConnPool.Exec(ctx, "INSERT INTO request_nonces (partner_id, nonce) VALUES ($1, $2) ON CONFLICT DO NOTHING;", partnerId, nonce)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// purgeExpiredNonces deletes nonces that are outside of the signature window, as their requests would be rejected by the timestamp anyway
+func purgeExpiredNonces(ctx context.Context) {
+	ticker := time.NewTicker(SignatureWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := ConnPool.Exec(ctx, "DELETE FROM request_nonces WHERE created_at < NOW() - make_interval(secs => $1);", 2*SignatureWindow.Seconds())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to purge expired nonces: %v\n", err)
+			}
+		}
+	}
+}
+
+func verifySignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !SigningEnabled {
+			next(w, r)
+			return
+		}
+
+		partnerId := r.Header.Get("X-Partner-Id")
+		timestamp := r.Header.Get("X-Timestamp")
+		nonce := r.Header.Get("X-Nonce")
+		signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+		if partnerId == "" || nonce == "" || err != nil || len(signature) == 0 {
+			fmt.Fprintf(os.Stderr, "Missing signature headers\n")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(unixTime, 0)).Abs() > SignatureWindow {
+			fmt.Fprintf(os.Stderr, "Signature timestamp %s is outside of the accepted window\n", timestamp)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		reqBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			fmt.Fprintf(os.Stderr, "Signed request body over %d bytes\n", maxBytesErr.Limit)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read request body: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+		ctx := r.Context()
+		secrets, err := activePartnerSecrets(ctx, partnerId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to get partner secrets: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		valid := false
+		for _, secret := range secrets {
+			expected, _ := hex.DecodeString(signRequest(secret, r.Method, r.URL.Path, timestamp, nonce, reqBody))
+			if hmac.Equal(expected, signature) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			fmt.Fprintf(os.Stderr, "Invalid signature for partner %s\n", partnerId)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		isNew, err := storeNonce(ctx, partnerId, nonce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to store nonce: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !isNew {
+			fmt.Fprintf(os.Stderr, "Replayed nonce %s for partner %s\n", nonce, partnerId)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignatureBodyTooLarge(t *testing.T) {
+	SigningEnabled = true
+	defer func() { SigningEnabled = false }()
+
+	body := `{"valor": 10, "tipo": "c", "descricao": "` + strings.Repeat("a", maxSignedBodySize) + `"}`
+	req := httptest.NewRequest("POST", "/clientes/2/transacoes", strings.NewReader(body))
+	req.SetPathValue("id", "2")
+	req.Header.Set("X-Partner-Id", "partner")
+	req.Header.Set("X-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set("X-Nonce", "nonce")
+	req.Header.Set("X-Signature", "00")
+	res := httptest.NewRecorder()
+	verifySignature(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Handler called for a body over %d bytes", maxSignedBodySize)
+	})(res, req)
+
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got %d, wants %d", res.Code, http.StatusRequestEntityTooLarge)
+	}
+}
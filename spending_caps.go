@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// SpendingCaps are optional per account controls checked on top of the balance limit.
+// A NULL column in spending_caps means that cap is disabled.
+type SpendingCaps struct {
+	MaxDebitAmount      pgtype.Int8 `json:"max_debit_amount"`
+	MaxDailyDebitTotal  pgtype.Int8 `json:"max_daily_debit_total"`
+	MaxHourlyDebitCount pgtype.Int4 `json:"max_hourly_debit_count"`
+}
+
+var (
+	ErrSpendingCapExceeded = errors.New("debit exceeds the account's spending caps")
+	ErrMaxDebitAmount      = fmt.Errorf("%w: amount is above the maximum allowed for a single debit", ErrSpendingCapExceeded)
+	ErrMaxDailyDebitTotal  = fmt.Errorf("%w: debits in the last 24 hours would go above the maximum allowed total", ErrSpendingCapExceeded)
+	ErrMaxHourlyDebitCount = fmt.Errorf("%w: number of debits in the last hour reached the maximum allowed", ErrSpendingCapExceeded)
+	spendingCapErrorCodes  = map[error]string{
+		ErrMaxDebitAmount:      "limite_por_transacao_excedido",
+		ErrMaxDailyDebitTotal:  "limite_diario_excedido",
+		ErrMaxHourlyDebitCount: "limite_de_debitos_por_hora_excedido",
+	}
+)
+
+// checkSpendingCaps has to be called while holding the account's row lock (SELECT ... FOR UPDATE),
+// otherwise concurrent debits could read the same totals and go over the caps together.
+func checkSpendingCaps(amount Money, accountId string, caps SpendingCaps, tx pgx.Tx, ctx context.Context) error {
+	if caps.MaxDebitAmount.Valid && amount > Money(caps.MaxDebitAmount.Int64) {
+		return ErrMaxDebitAmount
+	}
+
+	if !caps.MaxDailyDebitTotal.Valid && !caps.MaxHourlyDebitCount.Valid {
+		return nil
+	}
+
+	var dailyTotal Money
+	var hourlyCount int64
+	row := tx.QueryRow(ctx, stmtRecentDebits, accountId)
+	err := row.Scan(&dailyTotal, &hourlyCount)
+	if err != nil {
+		return err
+	}
+
+	if caps.MaxDailyDebitTotal.Valid {
+		total, err := dailyTotal.Add(amount)
+		if err != nil || total > Money(caps.MaxDailyDebitTotal.Int64) {
+			return ErrMaxDailyDebitTotal
+		}
+	}
+
+	if caps.MaxHourlyDebitCount.Valid && hourlyCount+1 > int64(caps.MaxHourlyDebitCount.Int32) {
+		return ErrMaxHourlyDebitCount
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+var (
+	StatementCache              *ActivityStatementCache            // set when STATEMENT_CACHE is true
+	statementCacheMetrics       = expvar.NewMap("statement_cache") // hits, misses, invalidations and hit_ratio
+	statementCacheHits          = new(expvar.Int)
+	statementCacheMisses        = new(expvar.Int)
+	statementCacheHitRatio      = expvar.Func(func() any { return hitRatio(statementCacheHits.Value(), statementCacheMisses.Value()) })
+	statementCacheInvalidations = new(expvar.Int)
+)
+
+func init() {
+	statementCacheMetrics.Set("hits", statementCacheHits)
+	statementCacheMetrics.Set("misses", statementCacheMisses)
+	statementCacheMetrics.Set("invalidations", statementCacheInvalidations)
+	statementCacheMetrics.Set("hit_ratio", statementCacheHitRatio)
+}
+
+// ActivityStatementCache keeps the balance and last transactions of each account in memory. An account is
+// invalidated when a credit or debit commits through this replica and when the balance event of any replica
+// arrives through LISTEN/NOTIFY. If the listener loses its connection, events may have been missed and
+// everything is invalidated.
+type ActivityStatementCache struct {
+	mu          sync.Mutex
+	epoch       uint64
+	entries     map[int]cachedStatement
+	generations map[int]uint64
+}
+
+// cachedStatement has no data_extrato, which is set to the time of each request
+type cachedStatement struct {
+	statement ActivityStatementResponseBody
+	etag      string
+}
+
+// statementVersion is taken before querying the database, so a statement read before an invalidation is not cached after it
+type statementVersion struct {
+	epoch      uint64
+	generation uint64
+}
+
+func newActivityStatementCache() *ActivityStatementCache {
+	return &ActivityStatementCache{entries: map[int]cachedStatement{}, generations: map[int]uint64{}}
+}
+
+func (c *ActivityStatementCache) get(accountId int) (cachedStatement, statementVersion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[accountId]
+	if ok {
+		statementCacheHits.Add(1)
+	} else {
+		statementCacheMisses.Add(1)
+	}
+	return entry, statementVersion{epoch: c.epoch, generation: c.generations[accountId]}, ok
+}
+
+// store caches the statement unless the account was invalidated since version was taken
+func (c *ActivityStatementCache) store(accountId int, version statementVersion, entry cachedStatement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version.epoch != c.epoch || version.generation != c.generations[accountId] {
+		return
+	}
+	c.entries[accountId] = entry
+}
+
+// invalidate is a no-op on a nil cache, so callers do not need to know whether caching is enabled
+func (c *ActivityStatementCache) invalidate(accountId int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, accountId)
+	c.generations[accountId]++
+	statementCacheInvalidations.Add(1)
+}
+
+func (c *ActivityStatementCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statementCacheInvalidations.Add(int64(len(c.entries)))
+	c.entries = map[int]cachedStatement{}
+	c.generations = map[int]uint64{}
+	c.epoch++
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// activityStatementETag identifies the balance, limit and transactions of the statement, ignoring data_extrato
+func activityStatementETag(statement ActivityStatementResponseBody) string {
+	statement.Saldo.DataExtrato = ""
+	b, _ := json.Marshal(statement)
+	hash := fnv.New64a()
+	hash.Write(b)
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// etagMatches tells whether the If-None-Match header lists the ETag, comparing weakly as RFC 9110 asks for GET
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestActivityStatementCache(t *testing.T) {
+	t.Run("does not store a statement read before an invalidation", func(t *testing.T) {
+		cache := newActivityStatementCache()
+		_, version, _ := cache.get(1)
+		cache.invalidate(1)
+		cache.store(1, version, cachedStatement{etag: `"a"`})
+		if _, _, ok := cache.get(1); ok {
+			t.Errorf("Got a cached statement, wants none")
+		}
+
+		_, version, _ = cache.get(1)
+		cache.store(1, version, cachedStatement{etag: `"b"`})
+		if entry, _, ok := cache.get(1); !ok || entry.etag != `"b"` {
+			t.Errorf("Got %+v (cached: %t), wants the statement with ETag %s", entry, ok, `"b"`)
+		}
+	})
+
+	t.Run("clear drops every statement, including the ones being read", func(t *testing.T) {
+		cache := newActivityStatementCache()
+		_, version, _ := cache.get(1)
+		cache.store(1, version, cachedStatement{})
+		_, version, _ = cache.get(2)
+		cache.clear()
+		cache.store(2, version, cachedStatement{})
+
+		for accountId := range 2 {
+			if _, _, ok := cache.get(accountId + 1); ok {
+				t.Errorf("Account %d: got a cached statement, wants none", accountId+1)
+			}
+		}
+	})
+}
+
+func TestActivityStatementETag(t *testing.T) {
+	statement := ActivityStatementResponseBody{Saldo: Saldo{Total: 10, Limite: 1000, DataExtrato: "2024-01-01T00:00:00Z"}}
+	etag := activityStatementETag(statement)
+
+	statement.Saldo.DataExtrato = "2024-01-02T00:00:00Z"
+	if got := activityStatementETag(statement); got != etag {
+		t.Errorf("Got ETag %s after changing data_extrato, wants %s", got, etag)
+	}
+	statement.Saldo.Total = 11
+	if got := activityStatementETag(statement); got == etag {
+		t.Errorf("Got the same ETag %s after changing the balance, wants a new one", got)
+	}
+
+	cases := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{etag, true},
+		{"W/" + etag, true},
+		{`"other", ` + etag, true},
+		{"*", true},
+		{`"other"`, false},
+	}
+	for _, c := range cases {
+		if got := etagMatches(c.ifNoneMatch, etag); got != c.want {
+			t.Errorf("If-None-Match %q: got %t, wants %t", c.ifNoneMatch, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TransactionStrategy applies a validated credit or debit to the database, returning the new balance and limit.
+// Every strategy enforces the same rules, they only differ in how concurrent transactions of an account are handled.
+type TransactionStrategy interface {
+	Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error)
+}
+
+const (
+	TransactionModePessimistic  = "pessimistic"   // BEGIN, SELECT ... FOR UPDATE, UPDATE, INSERT and COMMIT, at TRANSACTION_ISOLATION
+	TransactionModeFunction     = "function"      // a single call to the execute_transaction function of seed.sql
+	TransactionModeConditional  = "conditional"   // a single UPDATE ... WHERE the limit allows it, without reading the balance first
+	TransactionModeSerializable = "serializable"  // no row lock, SERIALIZABLE isolation retried on conflicts
+	TransactionModeEventSourced = "event_sourced" // the balance is replayed from the transactions, accounts.balance is a projection
+)
+
+var (
+	TransactionMode       = TransactionModePessimistic // set by TRANSACTION_MODE
+	transactionStrategies = map[string]TransactionStrategy{
+		TransactionModePessimistic:  pessimisticStrategy{},
+		TransactionModeFunction:     functionStrategy{},
+		TransactionModeConditional:  conditionalStrategy{},
+		TransactionModeSerializable: serializableStrategy{},
+		TransactionModeEventSourced: eventSourcedStrategy{},
+	}
+)
+
+func transactionModes() []string {
+	modes := make([]string, 0, len(transactionStrategies))
+	for mode := range transactionStrategies {
+		modes = append(modes, mode)
+	}
+	slices.Sort(modes)
+	return modes
+}
+
+// applyTransaction runs the credit or debit, the ledger insert and the balance event inside tx.
+// Without lockAccount the debit reads the balance without FOR UPDATE, which is only safe under SERIALIZABLE.
+func applyTransaction(ctx context.Context, tx pgx.Tx, accountId string, reqBodyDTO TransactionRequestBody, lockAccount bool) (Account, error) {
+	var account Account
+	var err error
+	amount := reqBodyDTO.Valor
+
+	// update account's balance
+	if reqBodyDTO.Tipo == "c" {
+		account, err = executeCredit(amount, accountId, tx, ctx)
+	} else {
+		account, err = executeDebit(amount, accountId, reqBodyDTO.Descricao, lockAccount, tx, ctx)
+	}
+	if err != nil {
+		return account, err
+	}
+
+	_, err = recordTransaction(ctx, tx, accountId, reqBodyDTO, account)
+	return account, err
+}
+
+// recordTransaction inserts the bank transaction into the ledger and publishes its balance event, with the
+// balance and limit of account after it
+func recordTransaction(ctx context.Context, tx pgx.Tx, accountId string, reqBodyDTO TransactionRequestBody, account Account) (Transaction, error) {
+	// insert bank transaction
+	var transaction Transaction
+	row := tx.QueryRow(ctx, stmtInsertTransaction, accountId, reqBodyDTO.Valor, reqBodyDTO.Tipo, reqBodyDTO.Descricao)
+	err := row.Scan(&transaction.Id, &transaction.AccountId, &transaction.CreatedAt)
+	if err != nil {
+		return transaction, fmt.Errorf("failed to insert transaction: %w", err)
+	}
+
+	// publish the event to the outbox and to LISTEN/NOTIFY, in the same database transaction
+	event := BalanceEvent{
+		TransacaoId: transaction.Id,
+		ClienteId:   transaction.AccountId,
+		Valor:       reqBodyDTO.Valor,
+		Tipo:        reqBodyDTO.Tipo,
+		Descricao:   reqBodyDTO.Descricao,
+		RealizadaEm: transaction.CreatedAt.Time.UTC().Format(time.RFC3339),
+		Saldo:       account.Balance,
+		Limite:      account.BalanceLimit,
+	}
+	err = publishBalanceEvent(ctx, tx, event)
+	if err != nil {
+		return transaction, fmt.Errorf("failed to publish balance event: %w", err)
+	}
+	return transaction, nil
+}
+
+type pessimisticStrategy struct{}
+
+func (pessimisticStrategy) Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	var account Account
+	// wrap queries in a database transaction
+	err := inTransaction(ctx, TransactionIsolation, func(tx pgx.Tx) error {
+		var err error
+		account, err = applyTransaction(ctx, tx, accountId, reqBodyDTO, true)
+		return err
+	})
+	return account, err
+}
+
+type functionStrategy struct{}
+
+func (functionStrategy) Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	// the rules are evaluated in Go, under the row lock of the pessimistic strategy
+	if reqBodyDTO.Tipo == "d" && Rules != nil {
+		return pessimisticStrategy{}.Execute(ctx, accountId, reqBodyDTO)
+	}
+	return executeTransactionFunction(ctx, accountId, reqBodyDTO.Valor, reqBodyDTO.Tipo, reqBodyDTO.Descricao)
+}
+
+// serializableStrategy lets Postgres detect concurrent debits of the same account instead of locking its row.
+// The loser of a conflict fails with a serialization failure and is run again.
+type serializableStrategy struct{}
+
+func (serializableStrategy) Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	var account Account
+	err := inTransaction(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		var err error
+		account, err = applyTransaction(ctx, tx, accountId, reqBodyDTO, false)
+		return err
+	})
+	return account, err
+}
+
+// conditionalStrategy applies the transaction with a single statement: the UPDATE only matches when the limit
+// allows the debit, so the balance is never read before being changed. Accounts with spending caps need the
+// debits of the last hours under a lock and fall back to the pessimistic strategy, as do all debits with rules.
+type conditionalStrategy struct{}
+
+func (conditionalStrategy) Execute(ctx context.Context, accountId string, reqBodyDTO TransactionRequestBody) (Account, error) {
+	if reqBodyDTO.Tipo == "d" && Rules != nil {
+		return pessimisticStrategy{}.Execute(ctx, accountId, reqBodyDTO)
+	}
+
+	var account Account
+	var exists, hasCaps bool
+	var published int
+
+	query := stmtConditionalDebit
+	if reqBodyDTO.Tipo == "c" {
+		query = stmtConditionalCredit
+	}
+
+	row := ConnPool.QueryRow(ctx, query, accountId, reqBodyDTO.Valor, reqBodyDTO.Tipo, reqBodyDTO.Descricao, EventTransactionCreated)
+	err := row.Scan(&exists, &hasCaps, &account.Balance, &account.BalanceLimit, &published)
+	if err != nil {
+		return account, err
+	}
+
+	switch {
+	case published == 1:
+		return account, nil
+	case !exists:
+		return account, ErrNotFound
+	case reqBodyDTO.Tipo == "c":
+		return account, ErrAmountOverflow
+	case hasCaps:
+		return pessimisticStrategy{}.Execute(ctx, accountId, reqBodyDTO)
+	default:
+		return account, ErrInsufficientFunds
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxTransactionBodySize = 1024 // bytes, a valid transaction body is less than 100
+
+var (
+	ErrInvalidBody      = errors.New("body needs to be a single JSON object")
+	ErrMissingField     = errors.New("field is required")
+	ErrUnknownField     = errors.New("field is not allowed")
+	ErrInvalidFieldType = errors.New("field has the wrong type")
+	ErrAmountNotInteger = errors.New("amount needs to be an integer")
+	ErrAmountOutOfRange = errors.New("amount needs to be between 1 and 9223372036854775807")
+)
+
+// FieldError is returned in the campos of a 400 response, one for every invalid field of the request
+type FieldError struct {
+	Campo    string `json:"campo"`
+	Mensagem string `json:"mensagem"`
+}
+
+// ValidationError holds every invalid field of a request. errors.Is matches the error of any of the fields,
+// so callers can still check for ErrInvalidAmount and friends.
+type ValidationError struct {
+	Campos []FieldError
+	errs   []error
+}
+
+func (e *ValidationError) add(field string, err error) {
+	e.Campos = append(e.Campos, FieldError{Campo: field, Mensagem: err.Error()})
+	e.errs = append(e.errs, err)
+}
+
+func (e *ValidationError) has(field string) bool {
+	for _, fieldError := range e.Campos {
+		if fieldError.Campo == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Campos))
+	for _, fieldError := range e.Campos {
+		if fieldError.Campo == "" {
+			messages = append(messages, fieldError.Mensagem)
+			continue
+		}
+		messages = append(messages, fieldError.Campo+": "+fieldError.Mensagem)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.errs
+}
+
+// errOrNil avoids returning a nil *ValidationError as a non-nil error
+func (e *ValidationError) errOrNil() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+func writeValidationError(w http.ResponseWriter, err *ValidationError) {
+	b, _ := json.Marshal(ErrorResponseBody{Erro: "requisicao_invalida", Campos: err.Campos})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
+}
+
+// decodeTransactionRequest is the strict decoder of transaction bodies, shared by every API through UnmarshalJSON.
+// It rejects unknown and missing fields, fractional or out of range amounts and descriptions over 10 characters,
+// returning a *ValidationError with every invalid field. The fields that could be decoded are returned even then.
+func decodeTransactionRequest(data []byte) (TransactionRequestBody, error) {
+	var body TransactionRequestBody
+	var raw struct {
+		Valor     json.RawMessage `json:"valor"` // json.Number would accept numbers inside strings
+		Tipo      *string         `json:"tipo"`
+		Descricao *string         `json:"descricao"`
+	}
+	validationErr := &ValidationError{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&raw)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		if decoder.Decode(&struct{}{}) != io.EOF {
+			validationErr.add("", ErrInvalidBody)
+			return body, validationErr
+		}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		validationErr.add(typeErr.Field, ErrInvalidFieldType)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// the decoder has no typed error for unknown fields
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		validationErr.add(field, ErrUnknownField)
+	default:
+		validationErr.add("", ErrInvalidBody)
+		return body, validationErr
+	}
+
+	if raw.Valor == nil || string(raw.Valor) == "null" {
+		if !validationErr.has("valor") {
+			validationErr.add("valor", ErrMissingField)
+		}
+	} else {
+		amount, err := strconv.ParseInt(string(raw.Valor), 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			validationErr.add("valor", ErrAmountOutOfRange)
+		} else if _, floatErr := strconv.ParseFloat(string(raw.Valor), 64); err != nil && floatErr == nil {
+			validationErr.add("valor", ErrAmountNotInteger)
+		} else if err != nil {
+			validationErr.add("valor", ErrInvalidFieldType)
+		}
+		body.Valor = Money(amount)
+	}
+	if raw.Tipo == nil {
+		if !validationErr.has("tipo") {
+			validationErr.add("tipo", ErrMissingField)
+		}
+	} else {
+		body.Tipo = *raw.Tipo
+	}
+	if raw.Descricao == nil {
+		if !validationErr.has("descricao") {
+			validationErr.add("descricao", ErrMissingField)
+		}
+	} else {
+		body.Descricao = *raw.Descricao
+	}
+
+	// value checks of the fields that were decoded
+	var valueErr *ValidationError
+	if errors.As(validateTransactionRequest(body), &valueErr) {
+		for i, fieldError := range valueErr.Campos {
+			if !validationErr.has(fieldError.Campo) {
+				validationErr.add(fieldError.Campo, valueErr.errs[i])
+			}
+		}
+	}
+	return body, validationErr.errOrNil()
+}
+
+func (b *TransactionRequestBody) UnmarshalJSON(data []byte) error {
+	body, err := decodeTransactionRequest(data)
+	*b = body
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTransactionRequest(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string
+		err    error
+	}{
+		{`{"valor": 1000, "tipo": "c", "descricao": "descricao"}`, nil, nil},
+		{`{"valor": 9223372036854775807, "tipo": "d", "descricao": "ação única"}`, nil, nil},
+		{`{"valor": 1.5, "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrAmountNotInteger},
+		{`{"valor": 1e3, "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrAmountNotInteger},
+		{`{"valor": 9223372036854775808, "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrAmountOutOfRange},
+		{`{"valor": 99999999999999999999, "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrAmountOutOfRange},
+		{`{"valor": "1000", "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrInvalidFieldType},
+		{`{"valor": 0, "tipo": "c", "descricao": "Desc."}`, []string{"valor"}, ErrInvalidAmount},
+		{`{"valor": 1000, "descricao": "Desc."}`, []string{"tipo"}, ErrMissingField},
+		{`{"valor": 1000, "tipo": "x", "descricao": "Desc."}`, []string{"tipo"}, ErrUnknownBankTransactionType},
+		{`{"valor": 1000, "tipo": "c", "descricao": "ação única!"}`, []string{"descricao"}, ErrInvalidDescription},
+		{`{"valor": 1000, "tipo": "c", "descricao": "Desc.", "extra": 1}`, []string{"extra"}, ErrUnknownField},
+		{`{"valor": null, "tipo": 1, "descricao": ""}`, []string{"tipo", "valor", "descricao"}, ErrMissingField},
+		{`{"valor": 1000, "tipo": "c", "descricao": "Desc."} {}`, []string{""}, ErrInvalidBody},
+		{`[1000, "c", "Desc."]`, []string{""}, ErrInvalidBody},
+	}
+
+	for _, tt := range tests {
+		_, err := decodeTransactionRequest([]byte(tt.body))
+		if tt.err == nil {
+			if err != nil {
+				t.Errorf("Body %s: got error %v, wants none", tt.body, err)
+			}
+			continue
+		}
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || !errors.Is(err, tt.err) {
+			t.Errorf("Body %s: got error %v, wants %v", tt.body, err, tt.err)
+			continue
+		}
+		var fields []string
+		for _, fieldError := range validationErr.Campos {
+			fields = append(fields, fieldError.Campo)
+		}
+		if !slices.Equal(fields, tt.fields) {
+			t.Errorf("Body %s: got fields %v, wants %v", tt.body, fields, tt.fields)
+		}
+	}
+}
+
+func TestTransactionHandlerRejectsLargeBodies(t *testing.T) {
+	body := `{"valor": 1000, "tipo": "c", "descricao": "` + strings.Repeat("a", maxTransactionBodySize) + `"}`
+	req := httptest.NewRequest("POST", "/clientes/:id/transacoes", strings.NewReader(body))
+	req.SetPathValue("id", "1")
+	res := httptest.NewRecorder()
+	transactionHandler(res, req)
+
+	got := res.Code
+	want := http.StatusRequestEntityTooLarge
+	if got != want {
+		t.Errorf("Got %d, wants %d", got, want)
+	}
+}
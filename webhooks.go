@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Webhooks use a transactional outbox: publishBalanceEvent writes the event in the same database transaction as the
+// bank transaction, together with one pending delivery per active subscription of the account.
+// The dispatcher of each replica claims pending deliveries with SKIP LOCKED and POSTs them to the subscribers.
+
+const EventTransactionCreated = "transacao.criada"
+
+var (
+	WebhookMaxAttempts          = 8
+	WebhookBaseBackoff          = time.Second
+	WebhookMaxBackoff           = time.Hour
+	WebhookAllowPrivateNetworks = false // set by WEBHOOK_ALLOW_PRIVATE_NETWORKS
+	ErrWebhookPrivateAddress    = errors.New("webhook url resolves to a private, loopback or link-local address")
+	// no proxy: the address checked by checkWebhookAddress has to be the subscriber's, not the proxy's
+	webhookClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookAddress}).DialContext,
+		},
+	}
+	// how long a claimed delivery is hidden from the other dispatchers. The claimed deliveries are sent
+	// concurrently, so the claim only has to outlast one request and the update of its result.
+	WebhookClaimDuration = webhookClient.Timeout + 25*time.Second
+)
+
+type WebhookPayload struct {
+	Id       int64           `json:"id"`
+	Evento   string          `json:"evento"`
+	CriadoEm string          `json:"criado_em"`
+	Dados    json.RawMessage `json:"dados"`
+}
+
+type WebhookSubscriptionRequestBody struct {
+	Url    string `json:"url"`
+	Secret string `json:"secret"` // generated when empty
+}
+
+type WebhookSubscriptionResponseBody struct {
+	Id     int    `json:"id"`
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func isPrivateAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+}
+
+// checkWebhookAddress runs on every connection of the webhook client, after the host is resolved, so a subscriber
+// url cannot reach the internal network even when its DNS changes after the subscription or it redirects there
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	if WebhookAllowPrivateNetworks {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if isPrivateAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrWebhookPrivateAddress, address)
+	}
+	return nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WebhookBaseBackoff
+	for i := 1; i < attempts && backoff < WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, WebhookMaxBackoff)
+}
+
+type webhookDelivery struct {
+	id        int64
+	attempts  int
+	url       string
+	secret    string
+	eventId   int64
+	eventType string
+	payload   []byte
+	createdAt pgtype.Timestamptz
+}
+
+func deliverWebhook(ctx context.Context, delivery webhookDelivery) error {
+	body, _ := json.Marshal(WebhookPayload{
+		Id:       delivery.eventId,
+		Evento:   delivery.eventType,
+		CriadoEm: delivery.createdAt.Time.UTC().Format(time.RFC3339),
+		Dados:    delivery.payload,
+	})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(delivery.eventId, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(delivery.secret, timestamp, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("subscriber responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// dispatchPendingWebhooks claims up to limit deliveries that are due and sends them.
+// Failures are retried with exponential backoff until WebhookMaxAttempts, then the delivery is dead-lettered.
+func dispatchPendingWebhooks(ctx context.Context, limit int) (int, error) {
+	rows, err := ConnPool.Query(ctx, `
+    WITH claimed AS (
+      UPDATE webhook_deliveries d
+      SET attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+      WHERE d.id IN (
+        SELECT id FROM webhook_deliveries
+        WHERE status = 'pending' AND next_attempt_at <= NOW()
+        ORDER BY next_attempt_at
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+      )
+      RETURNING d.id, d.attempts, d.event_id, d.subscription_id
+    )
+    SELECT c.id, c.attempts, s.url, s.secret, e.id, e.event_type, e.payload, e.created_at
+    FROM claimed c
+    JOIN webhook_subscriptions s ON s.id = c.subscription_id
+    JOIN outbox_events e ON e.id = c.event_id;`, limit, WebhookClaimDuration.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		err = rows.Scan(&d.id, &d.attempts, &d.url, &d.secret, &d.eventId, &d.eventType, &d.payload, &d.createdAt)
+		if err != nil {
+			rows.Close()
+			releaseWebhookDeliveries(ctx, deliveries)
+			return 0, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if rows.Err() != nil {
+		releaseWebhookDeliveries(ctx, deliveries)
+		return 0, rows.Err()
+	}
+
+	// sent concurrently, one after the other the last ones would outlive the claim and be sent twice
+	errs := make([]error, len(deliveries))
+	var wg sync.WaitGroup
+	for i, d := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = recordWebhookDelivery(ctx, d, deliverWebhook(ctx, d))
+		}()
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return 0, err
+	}
+	return len(deliveries), nil
+}
+
+// recordWebhookDelivery marks the delivery as delivered, dead or due again after the backoff
+func recordWebhookDelivery(ctx context.Context, d webhookDelivery, deliveryErr error) error {
+	var err error
+	switch {
+	case deliveryErr == nil:
+		_, err = ConnPool.Exec(ctx, "UPDATE webhook_deliveries SET status = 'delivered', delivered_at = NOW(), last_error = NULL WHERE id = $1;", d.id)
+	case d.attempts >= WebhookMaxAttempts:
+		fmt.Fprintf(os.Stderr, "Webhook delivery %d is dead after %d attempts: %v\n", d.id, d.attempts, deliveryErr)
+		_, err = ConnPool.Exec(ctx, "UPDATE webhook_deliveries SET status = 'dead', last_error = $2 WHERE id = $1;", d.id, deliveryErr.Error())
+	default:
+		_, err = ConnPool.Exec(ctx, "UPDATE webhook_deliveries SET next_attempt_at = NOW() + make_interval(secs => $2), last_error = $3 WHERE id = $1;", d.id, webhookBackoff(d.attempts).Seconds(), deliveryErr.Error())
+	}
+	return err
+}
+
+// releaseWebhookDeliveries makes claimed deliveries that were not sent due again, without counting the attempt.
+// Deliveries that failed to be read stay claimed until WebhookClaimDuration passes.
+func releaseWebhookDeliveries(ctx context.Context, deliveries []webhookDelivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	ids := make([]int64, len(deliveries))
+	for i, d := range deliveries {
+		ids[i] = d.id
+	}
+	_, err := ConnPool.Exec(ctx, "UPDATE webhook_deliveries SET attempts = attempts - 1, next_attempt_at = NOW() WHERE id = ANY($1);", ids)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to release webhook deliveries: %v\n", err)
+	}
+}
+
+func runWebhookDispatcher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := dispatchPendingWebhooks(ctx, 100)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to dispatch webhooks: %v\n", err)
+			}
+		}
+	}
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	accountId := r.PathValue("id")
+	ctx := r.Context()
+
+	var reqBodyDTO WebhookSubscriptionRequestBody
+	err := json.NewDecoder(r.Body).Decode(&reqBodyDTO)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot parse request body: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	subscriberUrl, err := url.Parse(reqBodyDTO.Url)
+	if err != nil || (subscriberUrl.Scheme != "http" && subscriberUrl.Scheme != "https") || subscriberUrl.Host == "" {
+		fmt.Fprintf(os.Stderr, "Webhook url needs to be an absolute http(s) url\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// hosts given as an address are checked now, names are checked by the webhook client when they are resolved
+	if addr, err := netip.ParseAddr(subscriberUrl.Hostname()); err == nil && isPrivateAddress(addr) && !WebhookAllowPrivateNetworks {
+		fmt.Fprintf(os.Stderr, "Webhook url cannot be a private, loopback or link-local address\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	secret := reqBodyDTO.Secret
+	if secret == "" {
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		secret = hex.EncodeToString(raw)
+	}
+
+	var id int
+	row := ConnPool.QueryRow(ctx, `
+    INSERT INTO webhook_subscriptions (account_id, url, secret)
+    SELECT id, $2, $3 FROM accounts WHERE id = $1
+    RETURNING id;`, accountId, reqBodyDTO.Url, secret)
+	err = row.Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create webhook subscription: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(WebhookSubscriptionResponseBody{Id: id, Url: reqBodyDTO.Url, Secret: secret})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	tag, err := ConnPool.Exec(r.Context(), "UPDATE webhook_subscriptions SET active = false WHERE id = $1 AND account_id = $2 AND active;", r.PathValue("webhookId"), r.PathValue("id"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to delete webhook subscription: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ReplayWebhookResponseBody struct {
+	Reenviados int64 `json:"reenviados"`
+}
+
+// replayWebhookHandler queues again the dead-lettered deliveries of a subscription.
+// With ?desde=<event id> the deliveries already made since that event are sent again too.
+func replayWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since := int64(-1)
+	if r.URL.Query().Has("desde") {
+		var err error
+		since, err = strconv.ParseInt(r.URL.Query().Get("desde"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	tag, err := ConnPool.Exec(ctx, `
+    UPDATE webhook_deliveries d
+    SET status = 'pending', attempts = 0, next_attempt_at = NOW(), last_error = NULL
+    FROM webhook_subscriptions s
+    WHERE s.id = d.subscription_id AND s.id = $1 AND s.account_id = $2 AND s.active
+      AND (d.status = 'dead' OR (d.status = 'delivered' AND $3 >= 0 AND d.event_id >= $3));`, r.PathValue("webhookId"), r.PathValue("id"), since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to replay webhook deliveries: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(ReplayWebhookResponseBody{Reenviados: tag.RowsAffected()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
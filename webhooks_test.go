@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.0.0.5:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+	}
+	for _, tt := range tests {
+		err := checkWebhookAddress("tcp", tt.address, nil)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: got error %v, wants it allowed", tt.address, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrWebhookPrivateAddress) {
+			t.Errorf("%s: got error %v, wants %v", tt.address, err, ErrWebhookPrivateAddress)
+		}
+	}
+}
+
+func TestWebhookClientIgnoresProxy(t *testing.T) {
+	transport := webhookClient.Transport.(*http.Transport)
+	if transport.Proxy != nil {
+		t.Errorf("Got a proxy in the webhook client, wants none so the subscriber's address is the one checked")
+	}
+}
+
+func TestWebhookRoutesRequireAPIKey(t *testing.T) {
+	AuthEnabled = false
+	mux := http.NewServeMux()
+	for _, route := range apiRoutes() {
+		mux.HandleFunc(route.Pattern, route.Handler)
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/clientes/1/webhooks"},
+		{"DELETE", "/clientes/1/webhooks/1"},
+		{"POST", "/clientes/1/webhooks/1/reenviar"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, strings.NewReader(`{"url": "http://example.com"}`))
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: got status %d, wants %d", route.method, route.path, res.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The WebSocket API multiplexes many requests over one connection. Every message from the client has an id
+// that is echoed in its response, so responses can arrive out of order:
+//
+//	{"id": "1", "tipo": "transacao", "cliente_id": 1, "transacao": {"valor": 10, "tipo": "c", "descricao": "Desc."}}
+//	{"id": "2", "tipo": "extrato", "cliente_id": 1}
+//	{"id": "3", "tipo": "assinar", "cliente_id": 1}
+//	{"id": "4", "tipo": "cancelar_assinatura", "cliente_id": 1}
+//
+// After "assinar" the balance changes of the account are pushed as {"tipo": "evento", "evento": {...}}.
+
+const (
+	wsMaxMessageSize     = 64 * 1024
+	wsMaxInFlight        = 32 // requests of a connection processed at the same time
+	wsPongWait           = 60 * time.Second
+	wsPingInterval       = wsPongWait * 9 / 10
+	wsWriteWait          = 10 * time.Second
+	wsMessageTransaction = "transacao"
+	wsMessageStatement   = "extrato"
+	wsMessageSubscribe   = "assinar"
+	wsMessageUnsubscribe = "cancelar_assinatura"
+	wsMessageEvent       = "evento"
+)
+
+var (
+	wsUpgrader          = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+	ErrUnknownWSMessage = errors.New("unknown message type")
+)
+
+type WSRequest struct {
+	Id        string                  `json:"id"`
+	Tipo      string                  `json:"tipo"`
+	ClienteId int                     `json:"cliente_id"`
+	Transacao *TransactionRequestBody `json:"transacao,omitempty"`
+}
+
+type WSResponse struct {
+	Id        string                         `json:"id,omitempty"`
+	Tipo      string                         `json:"tipo"`
+	Status    int                            `json:"status,omitempty"` // same status code the HTTP API would return
+	Erro      string                         `json:"erro,omitempty"`
+	Campos    []FieldError                   `json:"campos,omitempty"`
+	Transacao *TransactionResponseBody       `json:"transacao,omitempty"`
+	Extrato   *ActivityStatementResponseBody `json:"extrato,omitempty"`
+	Evento    *BalanceEvent                  `json:"evento,omitempty"`
+}
+
+type wsConnection struct {
+	conn          *websocket.Conn
+	apiKey        *APIKey // nil when auth is disabled
+	writeMu       sync.Mutex
+	subscriptions map[int]func() // account id -> unsubscribe
+	mu            sync.Mutex
+}
+
+func (c *wsConnection) write(response WSResponse) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(response)
+}
+
+func (c *wsConnection) ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+}
+
+func (c *wsConnection) allows(scopes []string, accountId string) bool {
+	return c.apiKey == nil || c.apiKey.allows(scopes, accountId)
+}
+
+func (c *wsConnection) handle(ctx context.Context, req WSRequest) WSResponse {
+	response := WSResponse{Id: req.Id, Tipo: req.Tipo, Status: http.StatusOK}
+	accountId := strconv.Itoa(req.ClienteId)
+
+	// signatures cover the HTTP method, path and body, which messages do not have
+	if req.Tipo == wsMessageTransaction && SigningEnabled {
+		response.Status, response.Erro = transactionErrorStatus(ErrSignatureRequired)
+		return response
+	}
+
+	// every message about an account takes a token of its bucket, as its HTTP route does
+	if req.Tipo == wsMessageTransaction || req.Tipo == wsMessageStatement || req.Tipo == wsMessageSubscribe {
+		_, err := checkRateLimit(ctx, req.ClienteId)
+		if err != nil {
+			response.Status, response.Erro = transactionErrorStatus(err)
+			return response
+		}
+	}
+
+	switch req.Tipo {
+	case wsMessageTransaction:
+		if req.Transacao == nil {
+			response.Status = http.StatusBadRequest
+			return response
+		}
+		scope := ScopePostCredit
+		if req.Transacao.Tipo == "d" {
+			scope = ScopePostDebit
+		}
+		if !c.allows([]string{scope}, accountId) {
+			response.Status = http.StatusForbidden
+			return response
+		}
+
+		account, err := executeTransaction(ctx, accountId, *req.Transacao)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Transaction failed: %v\n", err)
+			response.Status, response.Erro = transactionErrorStatus(err)
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				response.Campos = validationErr.Campos
+			}
+			return response
+		}
+		response.Transacao = &TransactionResponseBody{Saldo: account.Balance, Limite: account.BalanceLimit}
+	case wsMessageStatement:
+		if !c.allows([]string{ScopeReadStatement}, accountId) {
+			response.Status = http.StatusForbidden
+			return response
+		}
+
+		statement, err := getActivityStatement(ctx, accountId)
+		if err == ErrNotFound {
+			response.Status = http.StatusNotFound
+			return response
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to query transactions: %v\n", err)
+			response.Status = http.StatusInternalServerError
+			return response
+		}
+		response.Extrato = &statement
+	case wsMessageSubscribe:
+		if !c.allows([]string{ScopeReadStatement}, accountId) {
+			response.Status = http.StatusForbidden
+			return response
+		}
+		if !BalanceEventsEnabled {
+			response.Status, response.Erro = transactionErrorStatus(ErrBalanceEventsDisabled)
+			return response
+		}
+		c.subscribe(ctx, req.ClienteId)
+	case wsMessageUnsubscribe:
+		c.unsubscribe(req.ClienteId)
+	default:
+		response.Status = http.StatusBadRequest
+		response.Erro = ErrUnknownWSMessage.Error()
+	}
+	return response
+}
+
+func (c *wsConnection) subscribe(ctx context.Context, accountId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscriptions[accountId]; ok {
+		return
+	}
+
+	events, unsubscribe := Events.subscribe(accountId)
+	c.subscriptions[accountId] = unsubscribe
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				c.write(WSResponse{Tipo: wsMessageEvent, Evento: &event})
+			}
+		}
+	}()
+}
+
+func (c *wsConnection) unsubscribe(accountId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if unsubscribe, ok := c.subscriptions[accountId]; ok {
+		unsubscribe()
+		delete(c.subscriptions, accountId)
+	}
+}
+
+func (c *wsConnection) unsubscribeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for accountId, unsubscribe := range c.subscriptions {
+		unsubscribe()
+		delete(c.subscriptions, accountId)
+	}
+}
+
+func webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	var apiKey *APIKey
+	if AuthEnabled {
+		key, err := requestAPIKey(r)
+		if err == ErrNoAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to find api key: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		apiKey = &key
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to upgrade to websocket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// the request context is not canceled when a hijacked connection closes
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &wsConnection{conn: conn, apiKey: apiKey, subscriptions: map[int]func(){}}
+	defer c.unsubscribeAll()
+
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	defer cancel()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if c.ping() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	slots := make(chan struct{}, wsMaxInFlight)
+	for {
+		var req WSRequest
+		err = conn.ReadJSON(&req)
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				// the transaction body is decoded by the same strict decoder as the HTTP API
+				c.write(WSResponse{Tipo: req.Tipo, Id: req.Id, Status: http.StatusBadRequest, Erro: "requisicao_invalida", Campos: validationErr.Campos})
+				continue
+			}
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.write(WSResponse{Tipo: req.Tipo, Id: req.Id, Status: http.StatusBadRequest, Erro: "mensagem_invalida"})
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				fmt.Fprintf(os.Stderr, "Websocket connection closed: %v\n", err)
+			}
+			return
+		}
+
+		slots <- struct{}{}
+		inFlight.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				inFlight.Done()
+			}()
+			c.write(c.handle(ctx, req))
+		}()
+	}
+}